@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/machinebox/graphql"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+type nodeSettings map[string]struct {
+	Enabled bool `json:"enabled"`
+}
+
+// capabilities caches the datasets available per zone and account ID. Each
+// entry is probed again once it's older than inventory_ttl.
+type capabilities struct {
+	mu      sync.Mutex
+	entries map[string]capabilityEntry
+}
+
+type capabilityEntry struct {
+	datasets map[string]bool
+	disabled map[string][]string
+	at       time.Time
+}
+
+// available reports whether dataset can be queried for the zone or account
+// id. Zones and accounts never probed successfully are assumed to have
+// every dataset, their queries fail like before detection.
+func (c *capabilities) available(id string, dataset string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[id]
+	if !ok {
+		return true
+	}
+	return entry.datasets[dataset]
+}
+
+// disabledNodes returns the nodes of dataset needed by exported metrics that
+// are disabled for the zone or account id, sorted. Queries for id leave them
+// out, see withDisabledNodes.
+func (c *capabilities) disabledNodes(id string, dataset string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[id].disabled[dataset]
+}
+
+func (c *capabilities) expired(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[id]
+	return !ok || inventoryExpired(entry.at)
+}
+
+// store records which nodes needed by exported metrics are enabled in
+// settings, which depends on the plan and add-ons. A dataset is available
+// when any of its nodes is, the disabled ones are left out of its queries.
+func (c *capabilities) store(id string, settings nodeSettings, datasets []string) {
+	available := map[string]bool{}
+	disabled := map[string][]string{}
+	for _, dataset := range datasets {
+		var enabled []string
+		for _, def := range metricDefs {
+			if def.dataset != dataset || def.node == "" || deniedMetrics.Has(def.name) || contains(enabled, def.node) || contains(disabled[dataset], def.node) {
+				continue
+			}
+			if settings[settingsNode(def.node)].Enabled {
+				enabled = append(enabled, def.node)
+			} else {
+				disabled[dataset] = append(disabled[dataset], def.node)
+			}
+		}
+		sort.Strings(disabled[dataset])
+		available[dataset] = len(enabled) > 0 || len(disabled[dataset]) == 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[id] = capabilityEntry{datasets: available, disabled: disabled, at: time.Now()}
+}
+
+// probe fetches the settings of the zones and accounts not probed within
+// inventory_ttl. Zones are probed in batches of cf_batch_size. A failed batch
+// or account is probed again next cycle, the others are still stored.
+func (c *capabilities) probe(ctx context.Context, zones []cloudflare.Zone, accounts []cloudflare.Account) error {
+	var errs []error
+	var pending []string
+	for _, z := range zones {
+		if c.expired(z.ID) {
+			pending = append(pending, z.ID)
+		}
+	}
+	for len(pending) > 0 {
+		n := min(viper.GetInt("cf_batch_size"), len(pending))
+		batch := pending[:n]
+		pending = pending[n:]
+		settings, err := fetchZoneSettings(ctx, batch)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// Zones missing from the response can't be queried at all.
+		for _, id := range batch {
+			c.store(id, settings[id], zoneDatasets())
+		}
+	}
+
+	for _, a := range accounts {
+		if !c.expired(a.ID) {
+			continue
+		}
+		settings, err := fetchAccountSettings(ctx, a.ID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.store(a.ID, settings, accountDatasets())
+	}
+	return errors.Join(errs...)
+}
+
+func zoneDatasets() []string {
+	datasets := make([]string, 0, len(zoneFetchers))
+	for _, f := range zoneFetchers {
+		datasets = append(datasets, f.dataset)
+	}
+	return datasets
+}
+
+func accountDatasets() []string {
+	datasets := make([]string, 0, len(accountFetchers))
+	for _, f := range accountFetchers {
+		datasets = append(datasets, f.dataset)
+	}
+	return datasets
+}
+
+// settingsSelection returns the settings fields of the nodes queried by
+// datasets.
+func settingsSelection(datasets []string) string {
+	nodes := map[string]bool{}
+	for _, def := range metricDefs {
+		if contains(datasets, def.dataset) && def.node != "" {
+			nodes[settingsNode(def.node)] = true
+		}
+	}
+	fields := make([]string, 0, len(nodes))
+	for node := range nodes {
+		fields = append(fields, node+" { enabled }")
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, "\n\t\t\t\t\t")
+}
+
+// fetchZoneSettings returns the node settings of zoneIDs keyed by zone ID.
+func fetchZoneSettings(ctx context.Context, zoneIDs []string) (map[string]nodeSettings, error) {
+	request := graphql.NewRequest(`
+	query ($zoneIDs: [String!]) {
+		viewer {
+			zones(filter: { zoneTag_in: $zoneIDs }) {
+				zoneTag
+				settings {
+					` + settingsSelection(zoneDatasets()) + `
+				}
+			}
+		}
+	}
+`)
+	setGraphQLAuth(ctx, request)
+	request.Var("zoneIDs", zoneIDs)
+
+	ctx = withDataset(ctx, datasetCapabilities)
+	graphqlClient := newGraphQLClient()
+	var resp struct {
+		Viewer struct {
+			Zones []struct {
+				ZoneTag  string       `json:"zoneTag"`
+				Settings nodeSettings `json:"settings"`
+			} `json:"zones"`
+		} `json:"viewer"`
+	}
+	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	settings := map[string]nodeSettings{}
+	for _, z := range resp.Viewer.Zones {
+		settings[z.ZoneTag] = z.Settings
+	}
+	return settings, nil
+}
+
+// fetchAccountSettings returns the node settings of the account.
+func fetchAccountSettings(ctx context.Context, accountID string) (nodeSettings, error) {
+	request := graphql.NewRequest(`
+	query ($accountID: String!) {
+		viewer {
+			accounts(filter: { accountTag: $accountID }) {
+				settings {
+					` + settingsSelection(accountDatasets()) + `
+				}
+			}
+		}
+	}
+`)
+	setGraphQLAuth(ctx, request)
+	request.Var("accountID", accountID)
+
+	ctx = withDataset(ctx, datasetCapabilities)
+	graphqlClient := newGraphQLClient()
+	var resp struct {
+		Viewer struct {
+			Accounts []struct {
+				Settings nodeSettings `json:"settings"`
+			} `json:"accounts"`
+		} `json:"viewer"`
+	}
+	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	settings := nodeSettings{}
+	for _, a := range resp.Viewer.Accounts {
+		settings = a.Settings
+	}
+	return settings, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// checkpoints remembers the end of the last window processed per tenant,
+// dataset and zone or account, so windows missed during a restart or a stall
+// can be fetched later. With an empty path the checkpoints are kept in memory
+// only.
+type checkpoints struct {
+	path string
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func checkpointKey(tenant string, dataset string, scopeID string) string {
+	return tenant + "/" + dataset + "/" + scopeID
+}
+
+// loadCheckpoints reads the state file at path. A missing file is not an
+// error, the exporter then starts without checkpoints.
+func loadCheckpoints(path string) (*checkpoints, error) {
+	c := &checkpoints{path: path, last: map[string]time.Time{}}
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.last); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// save writes the checkpoints to the state file, replacing it atomically.
+func (c *checkpoints) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.last, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// needs reports whether key still has to fetch w, the window at index i of
+// windows returned by backfillWindows. A key without checkpoint only fetches
+// the newest window. Keys whose checkpoint is older than the oldest window
+// fetch it, the minutes in between are lost.
+func (c *checkpoints) needs(key string, windows []timeWindow, i int) bool {
+	c.mu.Lock()
+	last, ok := c.last[key]
+	c.mu.Unlock()
+
+	w := windows[i]
+	if !ok {
+		return i == len(windows)-1
+	}
+	if last.After(w.mintime) {
+		return false
+	}
+	return i == 0 || last.After(windows[i-1].mintime)
+}
+
+// advance moves the checkpoint of keys to the end of w.
+func (c *checkpoints) advance(keys []string, w timeWindow) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		c.last[key] = w.maxtime
+	}
+}
+
+// retain drops the checkpoints of keys not in keys, left by zones and
+// accounts no longer selected.
+func (c *checkpoints) retain(keys map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.last {
+		if !keys[key] {
+			delete(c.last, key)
+		}
+	}
+}
+
+// behind reports whether the checkpoint of key is older than w, meaning
+// windows before w were never fetched.
+func (c *checkpoints) behind(key string, w timeWindow) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.last[key]
+	return ok && last.Before(w.mintime)
+}
+
+// backfillWindows returns up to max windows ending with current, oldest
+// first.
+func backfillWindows(current timeWindow, max int) []timeWindow {
+	step := current.maxtime.Sub(current.mintime)
+	windows := make([]timeWindow, max)
+	for i := range windows {
+		offset := time.Duration(max-1-i) * step
+		windows[i] = timeWindow{mintime: current.mintime.Add(-offset), maxtime: current.maxtime.Add(-offset)}
+	}
+	return windows
+}
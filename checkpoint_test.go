@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+)
+
+func TestBackfillWindows(t *testing.T) {
+	end := time.Date(2026, 1, 1, 0, 10, 0, 0, time.UTC)
+	current := timeWindow{mintime: end.Add(-time.Minute), maxtime: end}
+
+	windows := backfillWindows(current, 3)
+	want := []timeWindow{
+		{mintime: end.Add(-3 * time.Minute), maxtime: end.Add(-2 * time.Minute)},
+		{mintime: end.Add(-2 * time.Minute), maxtime: end.Add(-time.Minute)},
+		current,
+	}
+	if !reflect.DeepEqual(windows, want) {
+		t.Errorf("backfillWindows() = %v, want %v", windows, want)
+	}
+}
+
+func TestCheckpointsNeeds(t *testing.T) {
+	end := time.Date(2026, 1, 1, 0, 10, 0, 0, time.UTC)
+	windows := backfillWindows(timeWindow{mintime: end.Add(-time.Minute), maxtime: end}, 3)
+
+	tests := []struct {
+		name   string
+		last   *time.Time
+		needed []bool
+		behind bool
+	}{
+		{
+			name:   "no checkpoint fetches only the newest window",
+			needed: []bool{false, false, true},
+		},
+		{
+			name:   "up to date",
+			last:   &end,
+			needed: []bool{false, false, false},
+		},
+		{
+			name:   "resumes after the checkpoint",
+			last:   &windows[0].maxtime,
+			needed: []bool{false, true, true},
+		},
+		{
+			name:   "one window behind",
+			last:   &windows[1].maxtime,
+			needed: []bool{false, false, true},
+		},
+		{
+			name:   "exactly at the backfill cap",
+			last:   &windows[0].mintime,
+			needed: []bool{true, true, true},
+		},
+		{
+			name:   "beyond the backfill cap",
+			last:   timePtr(windows[0].mintime.Add(-time.Hour)),
+			needed: []bool{true, true, true},
+			behind: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cps, err := loadCheckpoints("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.last != nil {
+				cps.last["k"] = *tt.last
+			}
+			if behind := cps.behind("k", windows[0]); behind != tt.behind {
+				t.Errorf("behind() = %v, want %v", behind, tt.behind)
+			}
+			// A cycle advances the checkpoint after every fetched window.
+			var needed []bool
+			for i, w := range windows {
+				needed = append(needed, cps.needs("k", windows, i))
+				if needed[i] {
+					cps.advance([]string{"k"}, w)
+				}
+			}
+			if !reflect.DeepEqual(needed, tt.needed) {
+				t.Errorf("needs() = %v, want %v", needed, tt.needed)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestCheckpointsAdvanceAndResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	end := time.Date(2026, 1, 1, 0, 10, 0, 0, time.UTC)
+	windows := backfillWindows(timeWindow{mintime: end.Add(-time.Minute), maxtime: end}, 3)
+
+	cps, err := loadCheckpoints(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cps.advance([]string{"a", "b"}, windows[0])
+	if err := cps.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := loadCheckpoints(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if !resumed.last[key].Equal(windows[0].maxtime) {
+			t.Errorf("checkpoint of %s = %v, want %v", key, resumed.last[key], windows[0].maxtime)
+		}
+		if resumed.needs(key, windows, 0) || !resumed.needs(key, windows, 1) {
+			t.Errorf("%s doesn't resume with the window after its checkpoint", key)
+		}
+	}
+}
+
+func TestLoadCheckpointsFile(t *testing.T) {
+	dir := t.TempDir()
+
+	cps, err := loadCheckpoints(filepath.Join(dir, "missing.json"))
+	if err != nil {
+		t.Fatalf("missing state file: %v", err)
+	}
+	if len(cps.last) != 0 {
+		t.Errorf("missing state file loaded %v, want no checkpoints", cps.last)
+	}
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte(`{"a": "not a time"`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadCheckpoints(corrupt); err == nil {
+		t.Error("corrupt state file loaded, want an error")
+	}
+}
+
+func TestCheckpointsRetain(t *testing.T) {
+	cps, err := loadCheckpoints("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tn := &tenant{Name: "default"}
+	kept := testZone("kept.com", "free", "active", false)
+	for _, id := range []string{"kept.com", "gone.com"} {
+		cps.advance([]string{checkpointKey(tn.Name, datasetZoneTotals, id)}, timeWindow{maxtime: now})
+	}
+	cps.advance([]string{checkpointKey("removed", datasetZoneTotals, "kept.com")}, timeWindow{maxtime: now})
+
+	cps.retain(checkpointKeys([]tenantScope{{tenant: tn, zones: []cloudflare.Zone{kept}}}))
+	want := map[string]time.Time{checkpointKey(tn.Name, datasetZoneTotals, "kept.com"): now}
+	if !reflect.DeepEqual(cps.last, want) {
+		t.Errorf("retained %v, want %v", cps.last, want)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/machinebox/graphql"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+const (
+	retryMinBackoff = 1 * time.Second
+	retryMaxBackoff = 30 * time.Second
+)
+
+var (
+	clientsOnce      sync.Once
+	graphqlTransport *retryTransport
+	restTransport    *retryTransport
+	graphqlHTTP      *http.Client
+	restHTTP         *http.Client
+	sharedGraphQL    *graphql.Client
+)
+
+// initClients builds the HTTP clients shared by all API calls. Their
+// transports keep a rate limiter per tenant, as Cloudflare's quotas apply to
+// each set of credentials.
+func initClients() {
+	clientsOnce.Do(func() {
+		graphqlTransport = newRetryTransport("graphql", viper.GetFloat64("cf_graphql_rps"))
+		restTransport = newRetryTransport("rest", viper.GetFloat64("cf_rest_rps"))
+		graphqlHTTP = &http.Client{Transport: graphqlTransport}
+		restHTTP = &http.Client{Transport: restTransport}
+		sharedGraphQL = graphql.NewClient(viper.GetString("cf_graphql_endpoint"), graphql.WithHTTPClient(graphqlHTTP))
+	})
+}
+
+// retainClientTenants drops the rate limiters of tenants not in names.
+func retainClientTenants(names map[string]bool) {
+	initClients()
+	graphqlTransport.retain(names)
+	restTransport.retain(names)
+}
+
+// retryTransport throttles the requests of each tenant with a token bucket,
+// bounds every attempt with a timeout and retries network errors, 429 and 5xx
+// responses with exponential backoff and jitter, honoring Retry-After.
+type retryTransport struct {
+	api        string
+	next       http.RoundTripper
+	limit      rate.Limit
+	burst      int
+	timeout    time.Duration
+	maxRetries int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// newRetryTransport limits requests to rps per second, unlimited if rps is 0.
+// The bucket holds one token per concurrent query.
+func newRetryTransport(api string, rps float64) *retryTransport {
+	limit := rate.Inf
+	if rps > 0 {
+		limit = rate.Limit(rps)
+	}
+	return &retryTransport{
+		api:        api,
+		next:       &instrumentedTransport{api: api, next: http.DefaultTransport},
+		limit:      limit,
+		burst:      viper.GetInt("cf_concurrency"),
+		timeout:    time.Duration(viper.GetInt("cf_timeout")) * time.Second,
+		maxRetries: viper.GetInt("cf_max_retries"),
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	dataset, _ := ctx.Value(datasetContextKey{}).(string)
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		if err := t.limiter(ctx).Wait(ctx); err != nil {
+			return nil, err
+		}
+		if waited := time.Since(start); waited > time.Millisecond {
+			exporterAPIThrottleWait.With(prometheus.Labels{"api": t.api, "source": "limiter"}).Add(waited.Seconds())
+		}
+
+		resp, err := t.try(req)
+
+		reason := retryReason(ctx, resp, err)
+		if reason == "" || attempt >= t.maxRetries {
+			return resp, err
+		}
+
+		delay, throttled := retryDelay(resp, attempt)
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		log.Debug(t.api, " ", dataset, ": retrying after ", reason, " in ", delay)
+		exporterAPIRetries.With(prometheus.Labels{"api": t.api, "dataset": dataset, "reason": reason}).Inc()
+		if throttled {
+			exporterAPIThrottleWait.With(prometheus.Labels{"api": t.api, "source": "retry_after"}).Add(delay.Seconds())
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// limiter returns the token bucket of the tenant of ctx.
+func (t *retryTransport) limiter(ctx context.Context) *rate.Limiter {
+	name := tenantFromContext(ctx).Name
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.limiters[name]
+	if !ok {
+		if t.limiters == nil {
+			t.limiters = map[string]*rate.Limiter{}
+		}
+		l = rate.NewLimiter(t.limit, t.burst)
+		t.limiters[name] = l
+	}
+	return l
+}
+
+// retain drops the token buckets of tenants not in names.
+func (t *retryTransport) retain(names map[string]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name := range t.limiters {
+		if !names[name] {
+			delete(t.limiters, name)
+		}
+	}
+}
+
+// try sends one attempt of req, cancelled after the timeout unless the
+// response body was closed before.
+func (t *retryTransport) try(req *http.Request) (*http.Response, error) {
+	attempt := req
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		attempt = req.Clone(req.Context())
+		attempt.Body = body
+	}
+
+	cancel := func() {}
+	if t.timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(attempt.Context(), t.timeout)
+		attempt = attempt.WithContext(ctx)
+	}
+
+	resp, err := t.next.RoundTrip(attempt)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// retryReason returns why an attempt should be retried, or an empty string
+// if it shouldn't. Requests cancelled by their caller are never retried.
+func retryReason(ctx context.Context, resp *http.Response, err error) string {
+	switch {
+	case ctx.Err() != nil:
+		return ""
+	case err != nil:
+		return "network"
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return "429"
+	case resp.StatusCode >= 500:
+		return "5xx"
+	}
+	return ""
+}
+
+// retryDelay returns how long to wait before the next attempt. Retry-After
+// is honored when the response carries it, reported as throttled.
+func retryDelay(resp *http.Response, attempt int) (time.Duration, bool) {
+	if resp != nil {
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			if secs, err := strconv.Atoi(after); err == nil && secs >= 0 {
+				return time.Duration(secs) * time.Second, true
+			}
+			if at, err := http.ParseTime(after); err == nil {
+				return max(time.Until(at), 0), true
+			}
+		}
+	}
+
+	backoff := time.Duration(float64(retryMinBackoff) * math.Pow(2, float64(attempt)))
+	if backoff > retryMaxBackoff {
+		backoff = retryMaxBackoff
+	}
+	// Half of the backoff is fixed, the other half random, so queries
+	// throttled together don't retry together.
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)), false
+}
+
+// cancelBody releases the attempt's timeout once the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestRetryDelay(t *testing.T) {
+	header := func(value string) *http.Response {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Retry-After", value)
+		return resp
+	}
+	tests := []struct {
+		name      string
+		resp      *http.Response
+		attempt   int
+		min, max  time.Duration
+		throttled bool
+	}{
+		{"retry-after seconds", header("7"), 0, 7 * time.Second, 7 * time.Second, true},
+		{"retry-after zero", header("0"), 3, 0, 0, true},
+		{"retry-after date", header(time.Now().Add(20 * time.Second).UTC().Format(http.TimeFormat)), 0, 18 * time.Second, 20 * time.Second, true},
+		{"retry-after date passed", header(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)), 0, 0, 0, true},
+		{"retry-after invalid", header("soon"), 0, retryMinBackoff / 2, retryMinBackoff, false},
+		{"retry-after negative", header("-1"), 0, retryMinBackoff / 2, retryMinBackoff, false},
+		{"network error", nil, 0, retryMinBackoff / 2, retryMinBackoff, false},
+		{"first backoff", &http.Response{Header: http.Header{}}, 0, retryMinBackoff / 2, retryMinBackoff, false},
+		{"doubles per attempt", &http.Response{Header: http.Header{}}, 2, 2 * time.Second, 4 * time.Second, false},
+		{"capped", &http.Response{Header: http.Header{}}, 10, retryMaxBackoff / 2, retryMaxBackoff, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The jitter is random, every draw has to stay within bounds.
+			for i := 0; i < 100; i++ {
+				delay, throttled := retryDelay(tt.resp, tt.attempt)
+				if delay < tt.min || delay > tt.max {
+					t.Fatalf("retryDelay() = %v, want between %v and %v", delay, tt.min, tt.max)
+				}
+				if throttled != tt.throttled {
+					t.Fatalf("retryDelay() throttled = %v, want %v", throttled, tt.throttled)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		maxRetries int
+		wantStatus int
+		wantCalls  int32
+	}{
+		{"success", []int{200}, 3, 200, 1},
+		{"retries 429", []int{429, 200}, 3, 200, 2},
+		{"retries 5xx", []int{500, 502, 503, 200}, 3, 200, 4},
+		{"gives up after max retries", []int{503, 503, 503}, 2, 503, 3},
+		{"no retries", []int{503, 200}, 0, 503, 1},
+		{"client errors aren't retried", []int{400, 200}, 3, 400, 1},
+		{"not found isn't retried", []int{404, 200}, 3, 404, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != "query" {
+					t.Errorf("attempt %d sent body %q, want the original body", n, body)
+				}
+				// Retry-After keeps the test fast, backoff is covered by
+				// TestRetryDelay.
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(tt.statuses[min(int(n), len(tt.statuses))-1])
+			}))
+			defer server.Close()
+
+			transport := &retryTransport{
+				api:        "graphql",
+				next:       http.DefaultTransport,
+				limit:      rate.Inf,
+				burst:      1,
+				timeout:    time.Second,
+				maxRetries: tt.maxRetries,
+			}
+			client := &http.Client{Transport: transport}
+			resp, err := client.Post(server.URL, "text/plain", strings.NewReader("query"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("server called %d times, want %d", calls.Load(), tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryTransportTimeout(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	transport := &retryTransport{
+		api:        "rest",
+		next:       http.DefaultTransport,
+		limit:      rate.Inf,
+		burst:      1,
+		timeout:    100 * time.Millisecond,
+		maxRetries: 1,
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" || calls.Load() != 2 {
+		t.Errorf("got %q after %d calls, want ok after a timed out attempt and a retry", body, calls.Load())
+	}
+}
+
+func TestRetryTransportLimiterPerTenant(t *testing.T) {
+	transport := &retryTransport{limit: 1, burst: 1}
+	a := withTenant(context.Background(), &tenant{Name: "a"})
+	b := withTenant(context.Background(), &tenant{Name: "b"})
+
+	if transport.limiter(a) == transport.limiter(b) {
+		t.Fatal("tenants a and b share a rate limiter")
+	}
+	if !transport.limiter(a).Allow() || !transport.limiter(b).Allow() {
+		t.Error("a tenant's first request waited for the other tenant's")
+	}
+
+	transport.retain(map[string]bool{"b": true})
+	if _, ok := transport.limiters["a"]; ok {
+		t.Error("limiter of removed tenant a retained")
+	}
+	if _, ok := transport.limiters["b"]; !ok {
+		t.Error("limiter of tenant b dropped")
+	}
+}
@@ -2,17 +2,43 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
 	"strings"
 	"time"
 
 	cloudflare "github.com/cloudflare/cloudflare-go"
 	"github.com/machinebox/graphql"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-var (
-	cfGraphQLEndpoint = "https://api.cloudflare.com/client/v4/graphql/"
+const (
+	cfAPIBaseURL      = "https://api.cloudflare.com/client/v4"
+	cfGraphQLEndpoint = cfAPIBaseURL + "/graphql/"
+)
+
+// Datasets the exporter fetches from Cloudflare, used to label API errors.
+const (
+	datasetZones          = "zones"
+	datasetAccounts       = "accounts"
+	datasetFirewallRules  = "firewall_rules"
+	datasetHealthChecks   = "health_checks"
+	datasetZoneTotals     = "zone_totals"
+	datasetColocation     = "colocation"
+	datasetLoadBalancer   = "load_balancer"
+	datasetLogpushZone    = "logpush_zone"
+	datasetLogpushAccount = "logpush_account"
+	datasetWorkers        = "workers"
+	datasetWorkerScripts  = "worker_scripts"
+	datasetSubrequests    = "worker_subrequests"
+	datasetScheduled      = "worker_scheduled"
+	datasetQueues         = "queues"
+	datasetCapabilities   = "capabilities"
 )
 
 type cloudflareResponse struct {
@@ -63,6 +89,9 @@ type logpushResponse struct {
 			Final           int    `json:"final"`
 		}
 	} `json:"logpushHealthAdaptiveGroups"`
+
+	ZoneTag    string `json:"zoneTag"`
+	AccountTag string `json:"-"`
 }
 
 type accountResp struct {
@@ -89,6 +118,49 @@ type accountResp struct {
 			DurationP999 float32 `json:"durationP999"`
 		} `json:"quantiles"`
 	} `json:"workersInvocationsAdaptive"`
+
+	WorkersSubrequestsAdaptiveGroups []struct {
+		Dimensions struct {
+			ScriptName         string `json:"scriptName"`
+			Hostname           string `json:"hostname"`
+			CacheStatus        string `json:"cacheStatus"`
+			HTTPResponseStatus uint16 `json:"httpResponseStatus"`
+		} `json:"dimensions"`
+		Sum struct {
+			Subrequests uint64 `json:"subrequests"`
+		} `json:"sum"`
+	} `json:"workersSubrequestsAdaptiveGroups"`
+
+	WorkersInvocationsScheduled []struct {
+		ScriptName string  `json:"scriptName"`
+		Cron       string  `json:"cron"`
+		Status     string  `json:"status"`
+		CPUTimeUs  float64 `json:"cpuTimeUs"`
+	} `json:"workersInvocationsScheduled"`
+
+	QueueConsumerMetricsAdaptiveGroups []struct {
+		Count      uint64 `json:"count"`
+		Dimensions struct {
+			QueueID    string `json:"queueId"`
+			ScriptName string `json:"scriptName"`
+		} `json:"dimensions"`
+		Avg struct {
+			Concurrency float64 `json:"concurrency"`
+		} `json:"avg"`
+	} `json:"queueConsumerMetricsAdaptiveGroups"`
+
+	QueueBacklogAdaptiveGroups []struct {
+		Count      uint64 `json:"count"`
+		Dimensions struct {
+			QueueID string `json:"queueId"`
+		} `json:"dimensions"`
+		Avg struct {
+			Messages float64 `json:"messages"`
+			Bytes    float64 `json:"bytes"`
+		} `json:"avg"`
+	} `json:"queueBacklogAdaptiveGroups"`
+
+	AccountTag string `json:"-"`
 }
 
 type zoneRespColo struct {
@@ -134,6 +206,7 @@ type zoneResp struct {
 			} `json:"clientHTTPVersionMap"`
 			ClientSSL []struct {
 				Protocol string `json:"clientSSLProtocol"`
+				Requests uint64 `json:"requests"`
 			} `json:"clientSSLMap"`
 			ContentType []struct {
 				Bytes                   uint64 `json:"bytes"`
@@ -197,14 +270,38 @@ type zoneResp struct {
 	HealthCheckEventsAdaptiveGroups []struct {
 		Count      uint64 `json:"count"`
 		Dimensions struct {
-			HealthStatus  string `json:"healthStatus"`
-			OriginIP      string `json:"originIP"`
-			FailureReason string `json:"failureReason"`
-			Region        string `json:"region"`
-			Fqdn          string `json:"fqdn"`
+			HealthStatus string `json:"healthStatus"`
+			OriginIP     string `json:"originIP"`
+			Region       string `json:"region"`
+			Fqdn         string `json:"fqdn"`
 		} `json:"dimensions"`
 	} `json:"healthCheckEventsAdaptiveGroups"`
 
+	HealthCheckFailures []struct {
+		Count      uint64 `json:"count"`
+		Dimensions struct {
+			OriginIP             string `json:"originIP"`
+			FailureReason        string `json:"failureReason"`
+			OriginResponseStatus uint16 `json:"originResponseStatus"`
+			Region               string `json:"region"`
+			Fqdn                 string `json:"fqdn"`
+		} `json:"dimensions"`
+	} `json:"healthCheckFailures"`
+
+	HealthCheckEventsRtt []struct {
+		Count     uint64 `json:"count"`
+		Quantiles struct {
+			RttMsP50 float64 `json:"rttMsP50"`
+			RttMsP95 float64 `json:"rttMsP95"`
+			RttMsP99 float64 `json:"rttMsP99"`
+		} `json:"quantiles"`
+		Dimensions struct {
+			OriginIP string `json:"originIP"`
+			Region   string `json:"region"`
+			Fqdn     string `json:"fqdn"`
+		} `json:"dimensions"`
+	} `json:"healthCheckEventsRtt"`
+
 	ZoneTag string `json:"zoneTag"`
 }
 
@@ -212,14 +309,15 @@ type lbResp struct {
 	LoadBalancingRequestsAdaptiveGroups []struct {
 		Count      uint64 `json:"count"`
 		Dimensions struct {
-			LbName               string `json:"lbName"`
-			Proxied              uint8  `json:"proxied"`
-			Region               string `json:"region"`
-			SelectedOriginName   string `json:"selectedOriginName"`
-			SelectedPoolAvgRttMs uint64 `json:"selectedPoolAvgRttMs"`
-			SelectedPoolHealthy  uint8  `json:"selectedPoolHealthy"`
-			SelectedPoolName     string `json:"selectedPoolName"`
-			SteeringPolicy       string `json:"steeringPolicy"`
+			LbName                string `json:"lbName"`
+			Proxied               uint8  `json:"proxied"`
+			Region                string `json:"region"`
+			SelectedOriginName    string `json:"selectedOriginName"`
+			SelectedPoolAvgRttMs  uint64 `json:"selectedPoolAvgRttMs"`
+			SelectedPoolHealthy   uint8  `json:"selectedPoolHealthy"`
+			SelectedPoolName      string `json:"selectedPoolName"`
+			SessionAffinityStatus string `json:"sessionAffinityStatus"`
+			SteeringPolicy        string `json:"steeringPolicy"`
 		} `json:"dimensions"`
 	} `json:"loadBalancingRequestsAdaptiveGroups"`
 
@@ -250,45 +348,176 @@ type lbResp struct {
 	ZoneTag string `json:"zoneTag"`
 }
 
-func fetchZones() []cloudflare.Zone {
-	var api *cloudflare.API
-	var err error
-	if len(viper.GetString("cf_api_token")) > 0 {
-		api, err = cloudflare.NewWithAPIToken(viper.GetString("cf_api_token"))
-	} else {
-		api, err = cloudflare.New(viper.GetString("cf_api_key"), viper.GetString("cf_api_email"))
+// timeWindow is the range of analytics data queried from Cloudflare,
+// mintime inclusive and maxtime exclusive.
+type timeWindow struct {
+	mintime time.Time
+	maxtime time.Time
+}
+
+// currentTimeWindow returns the latest full window of the configured size that
+// is at least scrape_delay old. Windows are aligned to multiples of their size.
+func currentTimeWindow() timeWindow {
+	size := time.Duration(viper.GetInt("window")) * time.Second
+	now := time.Now().Add(-time.Duration(viper.GetInt("scrape_delay")) * time.Second).UTC()
+	now = now.Truncate(size)
+
+	return timeWindow{mintime: now.Add(-size), maxtime: now}
+}
+
+type datasetContextKey struct{}
+
+// withDataset tags API calls made with ctx with the dataset they fetch.
+func withDataset(ctx context.Context, dataset string) context.Context {
+	return context.WithValue(ctx, datasetContextKey{}, dataset)
+}
+
+// instrumentedTransport records latency and response size of Cloudflare API
+// calls. The dataset label is taken from the request context, see withDataset.
+type instrumentedTransport struct {
+	api  string
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	dataset, _ := req.Context().Value(datasetContextKey{}).(string)
+	start := time.Now()
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		exporterAPIRequestDuration.With(prometheus.Labels{"api": t.api, "dataset": dataset}).Observe(time.Since(start).Seconds())
+		return nil, err
+	}
+
+	resp.Body = &instrumentedBody{ReadCloser: resp.Body, done: func(size int) {
+		exporterAPIRequestDuration.With(prometheus.Labels{"api": t.api, "dataset": dataset}).Observe(time.Since(start).Seconds())
+		exporterAPIResponseSize.With(prometheus.Labels{"api": t.api, "dataset": dataset}).Observe(float64(size))
+	}}
+	return resp, nil
+}
+
+// instrumentedBody counts bytes read from a response body and reports the
+// total once the body is closed.
+type instrumentedBody struct {
+	io.ReadCloser
+	size int
+	done func(size int)
+}
+
+func (b *instrumentedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += n
+	return n, err
+}
+
+func (b *instrumentedBody) Close() error {
+	if b.done != nil {
+		b.done(b.size)
+		b.done = nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// newGraphQLClient returns the GraphQL client shared by all queries.
+func newGraphQLClient() *graphql.Client {
+	initClients()
+	return sharedGraphQL
+}
+
+// newCloudflareAPI returns a REST client for the credentials of the tenant
+// of ctx, talking to cf_api_base_url when it is set. Retries and rate
+// limiting are left to the shared transport.
+func newCloudflareAPI(ctx context.Context) (*cloudflare.API, error) {
+	initClients()
+	opts := []cloudflare.Option{
+		cloudflare.HTTPClient(restHTTP),
+		cloudflare.UsingRetryPolicy(0, 0, 0),
+		cloudflare.UsingRateLimit(math.Inf(1)),
 	}
+	if len(viper.GetString("cf_api_base_url")) > 0 {
+		opts = append(opts, cloudflare.BaseURL(strings.TrimSuffix(viper.GetString("cf_api_base_url"), "/")))
+	}
+
+	t := tenantFromContext(ctx)
+	if len(t.APIToken) > 0 {
+		return cloudflare.NewWithAPIToken(t.APIToken, opts...)
+	}
+	return cloudflare.New(t.APIKey, t.APIEmail, opts...)
+}
+
+// fetchZones lists the zones of accountIDs, or all zones the credentials can
+// see if accountIDs is nil.
+func fetchZones(ctx context.Context, accountIDs []string) ([]cloudflare.Zone, error) {
+	api, err := newCloudflareAPI(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	ctx := context.Background()
-	z, err := api.ListZones(ctx)
+	ctx = withDataset(ctx, datasetZones)
+	if accountIDs == nil {
+		z, err := api.ListZones(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return z, nil
+	}
+
+	var zones []cloudflare.Zone
+	for _, id := range accountIDs {
+		r, err := api.ListZonesContext(ctx, cloudflare.WithZoneFilters("", id, ""))
+		if err != nil {
+			return nil, err
+		}
+		for _, z := range r.Result {
+			if z.Account.ID == id {
+				zones = append(zones, z)
+			}
+		}
+	}
+	return zones, nil
+}
+
+// fetchHealthChecks returns the standalone health checks of the zone.
+func fetchHealthChecks(ctx context.Context, zoneID string) ([]cloudflare.Healthcheck, error) {
+	api, err := newCloudflareAPI(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return z
+	ctx = withDataset(ctx, datasetHealthChecks)
+	return api.Healthchecks(ctx, zoneID)
 }
 
-func fetchFirewallRules(zoneID string) map[string]string {
-	var api *cloudflare.API
-	var err error
-	if len(viper.GetString("cf_api_token")) > 0 {
-		api, err = cloudflare.NewWithAPIToken(viper.GetString("cf_api_token"))
-	} else {
-		api, err = cloudflare.New(viper.GetString("cf_api_key"), viper.GetString("cf_api_email"))
+// fetchWorkerScripts returns the worker scripts of the account.
+func fetchWorkerScripts(ctx context.Context, accountID string) ([]cloudflare.WorkerMetaData, error) {
+	api, err := newCloudflareAPI(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = withDataset(ctx, datasetWorkerScripts)
+	scripts, _, err := api.ListWorkers(ctx, cloudflare.AccountIdentifier(accountID), cloudflare.ListWorkersParams{})
+	if err != nil {
+		return nil, err
 	}
+	return scripts.WorkerList, nil
+}
+
+// fetchFirewallRules returns rule descriptions of the zone's firewall rules
+// and managed rulesets keyed by rule ID. Rulesets that can't be fetched are
+// skipped, so the returned map may be partial even when an error is returned.
+func fetchFirewallRules(ctx context.Context, zoneID string) (map[string]string, error) {
+	api, err := newCloudflareAPI(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	ctx := context.Background()
+	ctx = withDataset(ctx, datasetFirewallRules)
 	listOfRules, _, err := api.FirewallRules(ctx,
 		cloudflare.ZoneIdentifier(zoneID),
 		cloudflare.FirewallRuleListParams{})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	firewallRulesMap := make(map[string]string)
 
@@ -298,13 +527,16 @@ func fetchFirewallRules(zoneID string) map[string]string {
 
 	listOfRulesets, err := api.ListRulesets(ctx, cloudflare.ZoneIdentifier(zoneID), cloudflare.ListRulesetsParams{})
 	if err != nil {
-		log.Fatal(err)
+		return firewallRulesMap, err
 	}
+
+	var errs []error
 	for _, rulesetDesc := range listOfRulesets {
 		if rulesetDesc.Phase == "http_request_firewall_managed" {
 			ruleset, err := api.GetRuleset(ctx, cloudflare.ZoneIdentifier(zoneID), rulesetDesc.ID)
 			if err != nil {
-				log.Fatal(err)
+				errs = append(errs, fmt.Errorf("ruleset %s: %w", rulesetDesc.ID, err))
+				continue
 			}
 			for _, rule := range ruleset.Rules {
 				firewallRulesMap[rule.ID] = rule.Description
@@ -312,42 +544,40 @@ func fetchFirewallRules(zoneID string) map[string]string {
 		}
 	}
 
-	return firewallRulesMap
+	return firewallRulesMap, errors.Join(errs...)
 }
 
-func fetchAccounts() []cloudflare.Account {
-	var api *cloudflare.API
-	var err error
-	if len(viper.GetString("cf_api_token")) > 0 {
-		api, err = cloudflare.NewWithAPIToken(viper.GetString("cf_api_token"))
-	} else {
-		api, err = cloudflare.New(viper.GetString("cf_api_key"), viper.GetString("cf_api_email"))
-	}
+func fetchAccounts(ctx context.Context) ([]cloudflare.Account, error) {
+	api, err := newCloudflareAPI(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	ctx := context.Background()
+	ctx = withDataset(ctx, datasetAccounts)
 	a, _, err := api.Accounts(ctx, cloudflare.AccountsListParams{PaginationOptions: cloudflare.PaginationOptions{PerPage: 100}})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return a
+	return a, nil
 }
 
-func fetchZoneTotals(zoneIDs []string) (*cloudflareResponse, error) {
-	now := time.Now().Add(-time.Duration(viper.GetInt("scrape_delay")) * time.Second).UTC()
-	s := 60 * time.Second
-	now = now.Truncate(s)
-	now1mAgo := now.Add(-60 * time.Second)
+// zoneTotalsNodes are the nodes and aliases of the zone totals query.
+var zoneTotalsNodes = []string{"httpRequests1mGroups", "firewallEventsAdaptiveGroups", "httpRequestsAdaptiveGroups", "httpRequestsEdgeCountryHost", "healthCheckEventsAdaptiveGroups", "healthCheckFailures", "healthCheckEventsRtt"}
 
+func fetchZoneTotals(ctx context.Context, zoneIDs []string, w timeWindow) ([]zoneResp, error) {
 	request := graphql.NewRequest(`
-query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!) {
+query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!, $httpRequests1mGroups: Boolean!, $firewallEventsAdaptiveGroups: Boolean!, $httpRequestsAdaptiveGroups: Boolean!, $httpRequestsEdgeCountryHost: Boolean!, $healthCheckEventsAdaptiveGroups: Boolean!, $healthCheckFailures: Boolean!, $healthCheckEventsRtt: Boolean!,
+	$firewallEventsAdaptiveGroups_action: Boolean!, $firewallEventsAdaptiveGroups_source: Boolean!, $firewallEventsAdaptiveGroups_ruleId: Boolean!, $firewallEventsAdaptiveGroups_clientRequestHTTPHost: Boolean!, $firewallEventsAdaptiveGroups_clientCountryName: Boolean!,
+	$httpRequestsAdaptiveGroups_originResponseStatus: Boolean!, $httpRequestsAdaptiveGroups_clientCountryName: Boolean!, $httpRequestsAdaptiveGroups_clientRequestHTTPHost: Boolean!,
+	$httpRequestsEdgeCountryHost_edgeResponseStatus: Boolean!, $httpRequestsEdgeCountryHost_clientCountryName: Boolean!, $httpRequestsEdgeCountryHost_clientRequestHTTPHost: Boolean!,
+	$healthCheckEventsAdaptiveGroups_healthStatus: Boolean!, $healthCheckEventsAdaptiveGroups_originIP: Boolean!, $healthCheckEventsAdaptiveGroups_region: Boolean!, $healthCheckEventsAdaptiveGroups_fqdn: Boolean!,
+	$healthCheckFailures_originIP: Boolean!, $healthCheckFailures_region: Boolean!, $healthCheckFailures_fqdn: Boolean!, $healthCheckFailures_failureReason: Boolean!, $healthCheckFailures_originResponseStatus: Boolean!,
+	$healthCheckEventsRtt_originIP: Boolean!, $healthCheckEventsRtt_region: Boolean!, $healthCheckEventsRtt_fqdn: Boolean!) {
 	viewer {
 		zones(filter: { zoneTag_in: $zoneIDs }) {
 			zoneTag
-			httpRequests1mGroups(limit: $limit filter: { datetime: $maxtime }) {
+			httpRequests1mGroups(limit: $limit filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) @include(if: $httpRequests1mGroups) {
 				uniq {
 					uniques
 				}
@@ -400,58 +630,78 @@ query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!) {
 					datetime
 				}
 			}
-			firewallEventsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
+			firewallEventsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) @include(if: $firewallEventsAdaptiveGroups) {
 				count
 				dimensions {
-				  action
-				  source
-				  ruleId
-				  clientRequestHTTPHost
-				  clientCountryName
+				  action @include(if: $firewallEventsAdaptiveGroups_action)
+				  source @include(if: $firewallEventsAdaptiveGroups_source)
+				  ruleId @include(if: $firewallEventsAdaptiveGroups_ruleId)
+				  clientRequestHTTPHost @include(if: $firewallEventsAdaptiveGroups_clientRequestHTTPHost)
+				  clientCountryName @include(if: $firewallEventsAdaptiveGroups_clientCountryName)
 				}
 			}
-			httpRequestsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime, cacheStatus_notin: ["hit"] }) {
+			httpRequestsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime, cacheStatus_notin: ["hit"] }) @include(if: $httpRequestsAdaptiveGroups) {
 				count
 				dimensions {
-					originResponseStatus
-					clientCountryName
-					clientRequestHTTPHost
+					originResponseStatus @include(if: $httpRequestsAdaptiveGroups_originResponseStatus)
+					clientCountryName @include(if: $httpRequestsAdaptiveGroups_clientCountryName)
+					clientRequestHTTPHost @include(if: $httpRequestsAdaptiveGroups_clientRequestHTTPHost)
 				}
 			}
-			httpRequestsEdgeCountryHost: httpRequestsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
+			httpRequestsEdgeCountryHost: httpRequestsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) @include(if: $httpRequestsEdgeCountryHost) {
 				count
 				dimensions {
-					edgeResponseStatus
-					clientCountryName
-					clientRequestHTTPHost
+					edgeResponseStatus @include(if: $httpRequestsEdgeCountryHost_edgeResponseStatus)
+					clientCountryName @include(if: $httpRequestsEdgeCountryHost_clientCountryName)
+					clientRequestHTTPHost @include(if: $httpRequestsEdgeCountryHost_clientRequestHTTPHost)
 				}
 			}
-			healthCheckEventsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) {
+			healthCheckEventsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) @include(if: $healthCheckEventsAdaptiveGroups) {
 				count
 				dimensions {
-					healthStatus
-					originIP
-					region
-					fqdn
+					healthStatus @include(if: $healthCheckEventsAdaptiveGroups_healthStatus)
+					originIP @include(if: $healthCheckEventsAdaptiveGroups_originIP)
+					region @include(if: $healthCheckEventsAdaptiveGroups_region)
+					fqdn @include(if: $healthCheckEventsAdaptiveGroups_fqdn)
+				}
+			}
+			healthCheckFailures: healthCheckEventsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime, failureReason_neq: "" }) @include(if: $healthCheckFailures) {
+				count
+				dimensions {
+					originIP @include(if: $healthCheckFailures_originIP)
+					region @include(if: $healthCheckFailures_region)
+					fqdn @include(if: $healthCheckFailures_fqdn)
+					failureReason @include(if: $healthCheckFailures_failureReason)
+					originResponseStatus @include(if: $healthCheckFailures_originResponseStatus)
+				}
+			}
+			healthCheckEventsRtt: healthCheckEventsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime }) @include(if: $healthCheckEventsRtt) {
+				count
+				quantiles {
+					rttMsP50
+					rttMsP95
+					rttMsP99
+				}
+				dimensions {
+					originIP @include(if: $healthCheckEventsRtt_originIP)
+					region @include(if: $healthCheckEventsRtt_region)
+					fqdn @include(if: $healthCheckEventsRtt_fqdn)
 				}
 			}
 		}
 	}
 }
 `)
-	if len(viper.GetString("cf_api_token")) > 0 {
-		request.Header.Set("Authorization", "Bearer "+viper.GetString("cf_api_token"))
-	} else {
-		request.Header.Set("X-AUTH-EMAIL", viper.GetString("cf_api_email"))
-		request.Header.Set("X-AUTH-KEY", viper.GetString("cf_api_key"))
-	}
-	request.Var("limit", 9999)
-	request.Var("maxtime", now)
-	request.Var("mintime", now1mAgo)
+	setGraphQLAuth(ctx, request)
+	request.Var("limit", graphqlLimit)
+	request.Var("maxtime", w.maxtime)
+	request.Var("mintime", w.mintime)
 	request.Var("zoneIDs", zoneIDs)
+	includeNodes(ctx, request, datasetZoneTotals, zoneTotalsNodes...)
+	includeDimensions(request, datasetZoneTotals)
 
-	ctx := context.Background()
-	graphqlClient := graphql.NewClient(cfGraphQLEndpoint)
+	ctx = withDataset(ctx, datasetZoneTotals)
+	graphqlClient := newGraphQLClient()
 
 	var resp cloudflareResponse
 	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
@@ -459,17 +709,12 @@ query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!) {
 		return nil, err
 	}
 
-	return &resp, nil
+	return resp.Viewer.Zones, nil
 }
 
-func fetchColoTotals(zoneIDs []string) (*cloudflareResponseColo, error) {
-	now := time.Now().Add(-time.Duration(viper.GetInt("scrape_delay")) * time.Second).UTC()
-	s := 60 * time.Second
-	now = now.Truncate(s)
-	now1mAgo := now.Add(-60 * time.Second)
-
+func fetchColoTotals(ctx context.Context, zoneIDs []string, w timeWindow) ([]zoneRespColo, error) {
 	request := graphql.NewRequest(`
-	query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!) {
+	query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!, $httpRequestsAdaptiveGroups_clientRequestHTTPHost: Boolean!, $httpRequestsAdaptiveGroups_coloCode: Boolean!) {
 		viewer {
 			zones(filter: { zoneTag_in: $zoneIDs }) {
 				zoneTag
@@ -482,8 +727,8 @@ func fetchColoTotals(zoneIDs []string) (*cloudflareResponseColo, error) {
 							sampleInterval
 						}
 						dimensions {
-							clientRequestHTTPHost
-							coloCode
+							clientRequestHTTPHost @include(if: $httpRequestsAdaptiveGroups_clientRequestHTTPHost)
+							coloCode @include(if: $httpRequestsAdaptiveGroups_coloCode)
 							datetime
 						}
 						sum {
@@ -495,43 +740,33 @@ func fetchColoTotals(zoneIDs []string) (*cloudflareResponseColo, error) {
 			}
 		}
 `)
-	if len(viper.GetString("cf_api_token")) > 0 {
-		request.Header.Set("Authorization", "Bearer "+viper.GetString("cf_api_token"))
-	} else {
-		request.Header.Set("X-AUTH-EMAIL", viper.GetString("cf_api_email"))
-		request.Header.Set("X-AUTH-KEY", viper.GetString("cf_api_key"))
-	}
-	request.Var("limit", 9999)
-	request.Var("maxtime", now)
-	request.Var("mintime", now1mAgo)
+	setGraphQLAuth(ctx, request)
+	request.Var("limit", graphqlLimit)
+	request.Var("maxtime", w.maxtime)
+	request.Var("mintime", w.mintime)
 	request.Var("zoneIDs", zoneIDs)
+	includeDimensions(request, datasetColocation)
 
-	ctx := context.Background()
-	graphqlClient := graphql.NewClient(cfGraphQLEndpoint)
+	ctx = withDataset(ctx, datasetColocation)
+	graphqlClient := newGraphQLClient()
 	var resp cloudflareResponseColo
 	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
 		log.Error(err)
 		return nil, err
 	}
 
-	return &resp, nil
+	return resp.Viewer.Zones, nil
 }
 
-func fetchWorkerTotals(accountID string) (*cloudflareResponseAccts, error) {
-	now := time.Now().Add(-time.Duration(viper.GetInt("scrape_delay")) * time.Second).UTC()
-	s := 60 * time.Second
-	now = now.Truncate(s)
-	now1mAgo := now.Add(-60 * time.Second)
-
+func fetchWorkerTotals(ctx context.Context, accountID string, w timeWindow) ([]accountResp, error) {
 	request := graphql.NewRequest(`
-	query ($accountID: String!, $mintime: Time!, $maxtime: Time!, $limit: Int!) {
+	query ($accountID: String!, $mintime: Time!, $maxtime: Time!, $limit: Int!, $workersInvocationsAdaptive_status: Boolean!) {
 		viewer {
 			accounts(filter: {accountTag: $accountID} ) {
 				workersInvocationsAdaptive(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime}) {
 					dimensions {
 						scriptName
-						status
-						datetime
+						status @include(if: $workersInvocationsAdaptive_status)
 					}
 
 					sum {
@@ -555,57 +790,182 @@ func fetchWorkerTotals(accountID string) (*cloudflareResponseAccts, error) {
 		}
 	}
 `)
-	if len(viper.GetString("cf_api_token")) > 0 {
-		request.Header.Set("Authorization", "Bearer "+viper.GetString("cf_api_token"))
-	} else {
-		request.Header.Set("X-AUTH-EMAIL", viper.GetString("cf_api_email"))
-		request.Header.Set("X-AUTH-KEY", viper.GetString("cf_api_key"))
-	}
-	request.Var("limit", 9999)
-	request.Var("maxtime", now)
-	request.Var("mintime", now1mAgo)
+	setGraphQLAuth(ctx, request)
+	request.Var("limit", graphqlLimit)
+	request.Var("maxtime", w.maxtime)
+	request.Var("mintime", w.mintime)
 	request.Var("accountID", accountID)
+	includeDimensions(request, datasetWorkers)
 
-	ctx := context.Background()
-	graphqlClient := graphql.NewClient(cfGraphQLEndpoint)
+	ctx = withDataset(ctx, datasetWorkers)
+	graphqlClient := newGraphQLClient()
 	var resp cloudflareResponseAccts
 	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
 		log.Error(err)
 		return nil, err
 	}
+	for i := range resp.Viewer.Accounts {
+		resp.Viewer.Accounts[i].AccountTag = accountID
+	}
 
-	return &resp, nil
+	return resp.Viewer.Accounts, nil
 }
 
-func fetchLoadBalancerTotals(zoneIDs []string) (*cloudflareResponseLb, error) {
-	now := time.Now().Add(-time.Duration(viper.GetInt("scrape_delay")) * time.Second).UTC()
-	s := 60 * time.Second
-	now = now.Truncate(s)
-	now1mAgo := now.Add(-60 * time.Second)
+func fetchWorkerSubrequests(ctx context.Context, accountID string, w timeWindow) ([]accountResp, error) {
+	request := graphql.NewRequest(`
+	query ($accountID: String!, $mintime: Time!, $maxtime: Time!, $limit: Int!,
+		$workersSubrequestsAdaptiveGroups_hostname: Boolean!, $workersSubrequestsAdaptiveGroups_cacheStatus: Boolean!, $workersSubrequestsAdaptiveGroups_httpResponseStatus: Boolean!) {
+		viewer {
+			accounts(filter: {accountTag: $accountID} ) {
+				workersSubrequestsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime}) {
+					dimensions {
+						scriptName
+						hostname @include(if: $workersSubrequestsAdaptiveGroups_hostname)
+						cacheStatus @include(if: $workersSubrequestsAdaptiveGroups_cacheStatus)
+						httpResponseStatus @include(if: $workersSubrequestsAdaptiveGroups_httpResponseStatus)
+					}
+					sum {
+						subrequests
+					}
+				}
+			}
+		}
+	}
+`)
+	setGraphQLAuth(ctx, request)
+	request.Var("limit", graphqlLimit)
+	request.Var("maxtime", w.maxtime)
+	request.Var("mintime", w.mintime)
+	request.Var("accountID", accountID)
+	includeDimensions(request, datasetSubrequests)
+
+	ctx = withDataset(ctx, datasetSubrequests)
+	graphqlClient := newGraphQLClient()
+	var resp cloudflareResponseAccts
+	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	for i := range resp.Viewer.Accounts {
+		resp.Viewer.Accounts[i].AccountTag = accountID
+	}
+
+	return resp.Viewer.Accounts, nil
+}
+
+// fetchWorkerScheduled returns the cron invocations of the account, a row
+// per invocation.
+func fetchWorkerScheduled(ctx context.Context, accountID string, w timeWindow) ([]accountResp, error) {
+	request := graphql.NewRequest(`
+	query ($accountID: String!, $mintime: Time!, $maxtime: Time!, $limit: Int!) {
+		viewer {
+			accounts(filter: {accountTag: $accountID} ) {
+				workersInvocationsScheduled(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime}) {
+					scriptName
+					cron
+					status
+					cpuTimeUs
+				}
+			}
+		}
+	}
+`)
+	setGraphQLAuth(ctx, request)
+	request.Var("limit", graphqlLimit)
+	request.Var("maxtime", w.maxtime)
+	request.Var("mintime", w.mintime)
+	request.Var("accountID", accountID)
+
+	ctx = withDataset(ctx, datasetScheduled)
+	graphqlClient := newGraphQLClient()
+	var resp cloudflareResponseAccts
+	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	for i := range resp.Viewer.Accounts {
+		resp.Viewer.Accounts[i].AccountTag = accountID
+	}
 
+	return resp.Viewer.Accounts, nil
+}
+
+func fetchQueues(ctx context.Context, accountID string, w timeWindow) ([]accountResp, error) {
 	request := graphql.NewRequest(`
-	query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!) {
+	query ($accountID: String!, $mintime: Time!, $maxtime: Time!, $limit: Int!, $queueConsumerMetricsAdaptiveGroups: Boolean!, $queueBacklogAdaptiveGroups: Boolean!) {
+		viewer {
+			accounts(filter: {accountTag: $accountID} ) {
+				queueConsumerMetricsAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime}) @include(if: $queueConsumerMetricsAdaptiveGroups) {
+					count
+					dimensions {
+						queueId
+						scriptName
+					}
+					avg {
+						concurrency
+					}
+				}
+				queueBacklogAdaptiveGroups(limit: $limit, filter: { datetime_geq: $mintime, datetime_lt: $maxtime}) @include(if: $queueBacklogAdaptiveGroups) {
+					count
+					dimensions {
+						queueId
+					}
+					avg {
+						messages
+						bytes
+					}
+				}
+			}
+		}
+	}
+`)
+	setGraphQLAuth(ctx, request)
+	request.Var("limit", graphqlLimit)
+	request.Var("maxtime", w.maxtime)
+	request.Var("mintime", w.mintime)
+	request.Var("accountID", accountID)
+	includeNodes(ctx, request, datasetQueues, "queueConsumerMetricsAdaptiveGroups", "queueBacklogAdaptiveGroups")
+
+	ctx = withDataset(ctx, datasetQueues)
+	graphqlClient := newGraphQLClient()
+	var resp cloudflareResponseAccts
+	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	for i := range resp.Viewer.Accounts {
+		resp.Viewer.Accounts[i].AccountTag = accountID
+	}
+
+	return resp.Viewer.Accounts, nil
+}
+
+func fetchLoadBalancerTotals(ctx context.Context, zoneIDs []string, w timeWindow) ([]lbResp, error) {
+	request := graphql.NewRequest(`
+	query ($zoneIDs: [String!], $mintime: Time!, $maxtime: Time!, $limit: Int!, $loadBalancingRequestsAdaptiveGroups: Boolean!, $loadBalancingRequestsAdaptive: Boolean!,
+		$loadBalancingRequestsAdaptiveGroups_steeringPolicy: Boolean!, $loadBalancingRequestsAdaptiveGroups_sessionAffinityStatus: Boolean!, $loadBalancingRequestsAdaptiveGroups_proxied: Boolean!) {
 		viewer {
 			zones(filter: { zoneTag_in: $zoneIDs }) {
 				zoneTag
 				loadBalancingRequestsAdaptiveGroups(
 					filter: { datetime_geq: $mintime, datetime_lt: $maxtime},
-					limit: $limit) {
+					limit: $limit) @include(if: $loadBalancingRequestsAdaptiveGroups) {
 					count
 					dimensions {
 						region
 						lbName
 						selectedPoolName
-						proxied
+						proxied @include(if: $loadBalancingRequestsAdaptiveGroups_proxied)
 						selectedOriginName
 						selectedPoolAvgRttMs
 						selectedPoolHealthy
-						steeringPolicy
+						steeringPolicy @include(if: $loadBalancingRequestsAdaptiveGroups_steeringPolicy)
+						sessionAffinityStatus @include(if: $loadBalancingRequestsAdaptiveGroups_sessionAffinityStatus)
 					}
 				}
 				loadBalancingRequestsAdaptive(
 					filter: { datetime_geq: $mintime, datetime_lt: $maxtime},
-					limit: $limit) {
+					limit: $limit) @include(if: $loadBalancingRequestsAdaptive) {
 					lbName
 					proxied
 					region
@@ -632,33 +992,25 @@ func fetchLoadBalancerTotals(zoneIDs []string) (*cloudflareResponseLb, error) {
 		}
 	}
 `)
-	if len(viper.GetString("cf_api_token")) > 0 {
-		request.Header.Set("Authorization", "Bearer "+viper.GetString("cf_api_token"))
-	} else {
-		request.Header.Set("X-AUTH-EMAIL", viper.GetString("cf_api_email"))
-		request.Header.Set("X-AUTH-KEY", viper.GetString("cf_api_key"))
-	}
-	request.Var("limit", 9999)
-	request.Var("maxtime", now)
-	request.Var("mintime", now1mAgo)
+	setGraphQLAuth(ctx, request)
+	request.Var("limit", graphqlLimit)
+	request.Var("maxtime", w.maxtime)
+	request.Var("mintime", w.mintime)
 	request.Var("zoneIDs", zoneIDs)
+	includeNodes(ctx, request, datasetLoadBalancer, "loadBalancingRequestsAdaptiveGroups", "loadBalancingRequestsAdaptive")
+	includeDimensions(request, datasetLoadBalancer)
 
-	ctx := context.Background()
-	graphqlClient := graphql.NewClient(cfGraphQLEndpoint)
+	ctx = withDataset(ctx, datasetLoadBalancer)
+	graphqlClient := newGraphQLClient()
 	var resp cloudflareResponseLb
 	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
 		log.Error(err)
 		return nil, err
 	}
-	return &resp, nil
+	return resp.Viewer.Zones, nil
 }
 
-func fetchLogpushAccount(accountID string) (*cloudflareResponseLogpushAccount, error) {
-	now := time.Now().Add(-time.Duration(viper.GetInt("scrape_delay")) * time.Second).UTC()
-	s := 60 * time.Second
-	now = now.Truncate(s)
-	now1mAgo := now.Add(-60 * time.Second)
-
+func fetchLogpushAccount(ctx context.Context, accountID string, w timeWindow) ([]logpushResponse, error) {
 	request := graphql.NewRequest(`query($accountID: String!, $limit: Int!, $mintime: Time!, $maxtime: Time!) {
 		viewer {
 		  accounts(filter: {accountTag : $accountID }) {
@@ -683,37 +1035,31 @@ func fetchLogpushAccount(accountID string) (*cloudflareResponseLogpushAccount, e
 		}
 	  }`)
 
-	if len(viper.GetString("cf_api_token")) > 0 {
-		request.Header.Set("Authorization", "Bearer "+viper.GetString("cf_api_token"))
-	} else {
-		request.Header.Set("X-AUTH-EMAIL", viper.GetString("cf_api_email"))
-		request.Header.Set("X-AUTH-KEY", viper.GetString("cf_api_key"))
-	}
+	setGraphQLAuth(ctx, request)
 
 	request.Var("accountID", accountID)
-	request.Var("limit", 9999)
-	request.Var("maxtime", now)
-	request.Var("mintime", now1mAgo)
+	request.Var("limit", graphqlLimit)
+	request.Var("maxtime", w.maxtime)
+	request.Var("mintime", w.mintime)
 
-	ctx := context.Background()
-	graphqlClient := graphql.NewClient(cfGraphQLEndpoint)
+	ctx = withDataset(ctx, datasetLogpushAccount)
+	graphqlClient := newGraphQLClient()
 	var resp cloudflareResponseLogpushAccount
 	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
 		log.Error(err)
 		return nil, err
 	}
-	return &resp, nil
+	for i := range resp.Viewer.Accounts {
+		resp.Viewer.Accounts[i].AccountTag = accountID
+	}
+	return resp.Viewer.Accounts, nil
 }
 
-func fetchLogpushZone(zoneIDs []string) (*cloudflareResponseLogpushZone, error) {
-	now := time.Now().Add(-time.Duration(viper.GetInt("scrape_delay")) * time.Second).UTC()
-	s := 60 * time.Second
-	now = now.Truncate(s)
-	now1mAgo := now.Add(-60 * time.Second)
-
+func fetchLogpushZone(ctx context.Context, zoneIDs []string, w timeWindow) ([]logpushResponse, error) {
 	request := graphql.NewRequest(`query($zoneIDs: String!, $limit: Int!, $mintime: Time!, $maxtime: Time!) {
 		viewer {
 			zones(filter: {zoneTag_in : $zoneIDs }) {
+			zoneTag
 			logpushHealthAdaptiveGroups(
 			  filter: {
 				datetime_geq: $mintime
@@ -735,27 +1081,22 @@ func fetchLogpushZone(zoneIDs []string) (*cloudflareResponseLogpushZone, error)
 		}
 	  }`)
 
-	if len(viper.GetString("cf_api_token")) > 0 {
-		request.Header.Set("Authorization", "Bearer "+viper.GetString("cf_api_token"))
-	} else {
-		request.Header.Set("X-AUTH-EMAIL", viper.GetString("cf_api_email"))
-		request.Header.Set("X-AUTH-KEY", viper.GetString("cf_api_key"))
-	}
+	setGraphQLAuth(ctx, request)
 
 	request.Var("zoneIDs", zoneIDs)
-	request.Var("limit", 9999)
-	request.Var("maxtime", now)
-	request.Var("mintime", now1mAgo)
+	request.Var("limit", graphqlLimit)
+	request.Var("maxtime", w.maxtime)
+	request.Var("mintime", w.mintime)
 
-	ctx := context.Background()
-	graphqlClient := graphql.NewClient(cfGraphQLEndpoint)
+	ctx = withDataset(ctx, datasetLogpushZone)
+	graphqlClient := newGraphQLClient()
 	var resp cloudflareResponseLogpushZone
 	if err := graphqlClient.Run(ctx, request, &resp); err != nil {
 		log.Error(err)
 		return nil, err
 	}
 
-	return &resp, nil
+	return resp.Viewer.Zones, nil
 }
 
 func findZoneAccountName(zones []cloudflare.Zone, ID string) (string, string) {
@@ -777,12 +1118,3 @@ func extractZoneIDs(zones []cloudflare.Zone) []string {
 
 	return IDs
 }
-
-func filterNonFreePlanZones(zones []cloudflare.Zone) (filteredZones []cloudflare.Zone) {
-	for _, z := range zones {
-		if z.Plan.ZonePlanCommon.ID != "0feeeeeeeeeeeeeeeeeeeeeeeeeeeeee" {
-			filteredZones = append(filteredZones, z)
-		}
-	}
-	return
-}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// fileConfig is the schema of the --config file. Unknown keys are rejected.
+type fileConfig struct {
+	Credentials struct {
+		Tenant          string `mapstructure:"tenant"`
+		APIToken        string `mapstructure:"api_token"`
+		APIKey          string `mapstructure:"api_key"`
+		APIEmail        string `mapstructure:"api_email"`
+		APIBaseURL      string `mapstructure:"api_base_url"`
+		GraphQLEndpoint string `mapstructure:"graphql_endpoint"`
+	} `mapstructure:"credentials"`
+
+	Tenants []tenant `mapstructure:"tenants"`
+
+	Selection struct {
+		Accounts         []string `mapstructure:"accounts"`
+		ExcludeAccounts  []string `mapstructure:"exclude_accounts"`
+		Zones            []string `mapstructure:"zones"`
+		ExcludeZones     []string `mapstructure:"exclude_zones"`
+		ZoneNames        []string `mapstructure:"zone_names"`
+		ExcludeZoneNames []string `mapstructure:"exclude_zone_names"`
+		ZonePlans        []string `mapstructure:"zone_plans"`
+		ZoneStatus       []string `mapstructure:"zone_status"`
+		ZonePaused       *bool    `mapstructure:"zone_paused"`
+		FreeTier         bool     `mapstructure:"free_tier"`
+	} `mapstructure:"selection"`
+
+	Datasets map[string]bool `mapstructure:"datasets"`
+
+	Labels struct {
+		Static map[string]string `mapstructure:"static"`
+	} `mapstructure:"labels"`
+
+	Metrics struct {
+		Mode       string                    `mapstructure:"mode"`
+		Denylist   []string                  `mapstructure:"denylist"`
+		Allowlist  []string                  `mapstructure:"allowlist"`
+		SeriesTTL  map[string]int            `mapstructure:"series_ttl"`
+		DropLabels map[string][]string       `mapstructure:"drop_labels"`
+		TopN       map[string]map[string]int `mapstructure:"top_n"`
+	} `mapstructure:"metrics"`
+
+	RelabelConfigs []relabelConfig `mapstructure:"relabel_configs"`
+
+	Collection struct {
+		ScrapeDelay        int     `mapstructure:"scrape_delay"`
+		CollectInterval    int     `mapstructure:"collect_interval"`
+		Window             int     `mapstructure:"window"`
+		BatchSize          int     `mapstructure:"batch_size"`
+		Concurrency        int     `mapstructure:"concurrency"`
+		BackfillMaxWindows int     `mapstructure:"backfill_max_windows"`
+		InventoryTTL       int     `mapstructure:"inventory_ttl"`
+		Timeout            int     `mapstructure:"timeout"`
+		MaxRetries         int     `mapstructure:"max_retries"`
+		GraphQLRPS         float64 `mapstructure:"graphql_rps"`
+		RESTRPS            float64 `mapstructure:"rest_rps"`
+	} `mapstructure:"collection"`
+
+	Output struct {
+		Listen      string `mapstructure:"listen"`
+		MetricsPath string `mapstructure:"metrics_path"`
+		StateFile   string `mapstructure:"state_file"`
+	} `mapstructure:"output"`
+}
+
+// configFileKeys maps the keys of the config file onto the settings also
+// available as flags and environment variables.
+var configFileKeys = []struct {
+	path string
+	key  string
+}{
+	{"credentials.tenant", "tenant"},
+	{"credentials.api_token", "cf_api_token"},
+	{"credentials.api_key", "cf_api_key"},
+	{"credentials.api_email", "cf_api_email"},
+	{"credentials.api_base_url", "cf_api_base_url"},
+	{"credentials.graphql_endpoint", "cf_graphql_endpoint"},
+	{"selection.accounts", "cf_accounts"},
+	{"selection.exclude_accounts", "cf_exclude_accounts"},
+	{"selection.zones", "cf_zones"},
+	{"selection.exclude_zones", "cf_exclude_zones"},
+	{"selection.zone_names", "cf_zone_names"},
+	{"selection.exclude_zone_names", "cf_exclude_zone_names"},
+	{"selection.zone_plans", "cf_zone_plans"},
+	{"selection.zone_status", "cf_zone_status"},
+	{"selection.zone_paused", "cf_zone_paused"},
+	{"selection.free_tier", "free_tier"},
+	{"datasets", "disabled_datasets"},
+	{"labels.static", "static_labels"},
+	{"metrics.mode", "metrics_mode"},
+	{"metrics.denylist", "metrics_denylist"},
+	{"metrics.allowlist", "metrics_allowlist"},
+	{"metrics.series_ttl", "metrics_series_ttl"},
+	{"metrics.drop_labels", "metrics_drop_labels"},
+	{"metrics.top_n", "metrics_top_n"},
+	{"collection.scrape_delay", "scrape_delay"},
+	{"collection.collect_interval", "collect_interval"},
+	{"collection.window", "window"},
+	{"collection.batch_size", "cf_batch_size"},
+	{"collection.concurrency", "cf_concurrency"},
+	{"collection.backfill_max_windows", "backfill_max_windows"},
+	{"collection.inventory_ttl", "inventory_ttl"},
+	{"collection.timeout", "cf_timeout"},
+	{"collection.max_retries", "cf_max_retries"},
+	{"collection.graphql_rps", "cf_graphql_rps"},
+	{"collection.rest_rps", "cf_rest_rps"},
+	{"output.listen", "listen"},
+	{"output.metrics_path", "metrics_path"},
+	{"output.state_file", "state_file"},
+}
+
+// staticSettings are only read at startup. Changing them in the config file
+// takes effect after a restart.
+var staticSettings = []string{
+	"listen", "metrics_path", "metrics_mode", "metrics_denylist", "metrics_allowlist", "metrics_series_ttl", "metrics_drop_labels", "metrics_top_n", "static_labels",
+	"state_file", "backfill_max_windows", "collect_interval", "cf_graphql_endpoint", "cf_timeout",
+	"cf_max_retries", "cf_graphql_rps", "cf_rest_rps",
+}
+
+// readConfigFile validates the config file at path and returns its settings
+// keyed like the flags. Lists are joined with commas and maps turned into
+// comma delimited key=value pairs, the format the flags use.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	fv := viper.New()
+	fv.SetConfigFile(path)
+	if err := fv.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var cfg fileConfig
+	if err := fv.UnmarshalExact(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	settings := map[string]interface{}{}
+	for _, k := range configFileKeys {
+		if !fv.IsSet(k.path) {
+			continue
+		}
+		switch k.path {
+		case "datasets":
+			var disabled []string
+			for dataset, enabled := range cfg.Datasets {
+				if !enabled {
+					disabled = append(disabled, dataset)
+				}
+			}
+			sort.Strings(disabled)
+			settings[k.key] = strings.Join(disabled, ",")
+		case "labels.static":
+			settings[k.key] = joinPairs(cfg.Labels.Static)
+		case "metrics.series_ttl":
+			ttl := map[string]string{}
+			for metric, windows := range cfg.Metrics.SeriesTTL {
+				ttl[metric] = strconv.Itoa(windows)
+			}
+			settings[k.key] = joinPairs(ttl)
+		case "metrics.drop_labels":
+			dropped := map[string]string{}
+			for metric, labels := range cfg.Metrics.DropLabels {
+				dropped[metric] = strings.Join(labels, "|")
+			}
+			settings[k.key] = joinPairs(dropped)
+		case "metrics.top_n":
+			ranked := map[string]string{}
+			for metric, labels := range cfg.Metrics.TopN {
+				pairs := make([]string, 0, len(labels))
+				for label, n := range labels {
+					pairs = append(pairs, label+":"+strconv.Itoa(n))
+				}
+				sort.Strings(pairs)
+				ranked[metric] = strings.Join(pairs, "|")
+			}
+			settings[k.key] = joinPairs(ranked)
+		default:
+			if list, ok := fv.Get(k.path).([]interface{}); ok {
+				items := make([]string, 0, len(list))
+				for _, item := range list {
+					items = append(items, fmt.Sprint(item))
+				}
+				settings[k.key] = strings.Join(items, ",")
+			} else {
+				settings[k.key] = fv.Get(k.path)
+			}
+		}
+	}
+	if len(cfg.Tenants) > 0 {
+		settings["tenants"] = fv.Get("tenants")
+	}
+	if len(cfg.RelabelConfigs) > 0 {
+		settings["relabel_configs"] = fv.Get("relabel_configs")
+	}
+	return settings, nil
+}
+
+func joinPairs(m map[string]string) string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// applyConfigSettings replaces viper's config file layer with settings.
+// Flags and environment variables still take precedence.
+func applyConfigSettings(settings map[string]interface{}) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	viper.SetConfigType("json")
+	return viper.ReadConfig(bytes.NewReader(data))
+}
+
+// validateConfig checks the settings, whatever they were configured with.
+func validateConfig() error {
+	tenants, err := loadTenants()
+	if err != nil {
+		return err
+	}
+	if err := validateTenants(tenants); err != nil {
+		return err
+	}
+	if viper.GetInt("cf_batch_size") < 1 || viper.GetInt("cf_batch_size") > 10 {
+		return errors.New("CF_BATCH_SIZE must be between 1 and 10")
+	}
+	if viper.GetInt("cf_concurrency") < 1 {
+		return errors.New("CF_CONCURRENCY must be at least 1")
+	}
+	if viper.GetInt("cf_timeout") < 1 {
+		return errors.New("CF_TIMEOUT must be at least 1 second")
+	}
+	if viper.GetInt("cf_max_retries") < 0 {
+		return errors.New("CF_MAX_RETRIES must not be negative")
+	}
+	if viper.GetFloat64("cf_graphql_rps") < 0 || viper.GetFloat64("cf_rest_rps") < 0 {
+		return errors.New("CF_GRAPHQL_RPS and CF_REST_RPS must not be negative")
+	}
+	if viper.GetInt("inventory_ttl") < 0 {
+		return errors.New("INVENTORY_TTL must not be negative")
+	}
+	if err := checkWindowTiming(viper.GetInt("window"), viper.GetInt("collect_interval"), viper.GetInt("scrape_delay")); err != nil {
+		return err
+	}
+	if viper.GetString("metrics_mode") == metricsModeCounter && viper.GetInt("collect_interval") > viper.GetInt("window")*viper.GetInt("backfill_max_windows") {
+		return errors.New("COLLECT_INTERVAL must not exceed WINDOW times BACKFILL_MAX_WINDOWS, windows would be skipped every cycle")
+	}
+	if viper.GetInt("backfill_max_windows") < 1 {
+		return errors.New("BACKFILL_MAX_WINDOWS must be at least 1")
+	}
+	if viper.GetString("metrics_mode") != metricsModeCounter && viper.GetString("metrics_mode") != metricsModeWindow {
+		return errors.New("METRICS_MODE must be either counter or window")
+	}
+	for _, dataset := range splitList(viper.GetString("disabled_datasets")) {
+		if !contains(toggledDatasets(), dataset) {
+			return fmt.Errorf("dataset %s doesn't exist, must be one of %s", dataset, strings.Join(toggledDatasets(), ", "))
+		}
+	}
+	if _, err := buildDeniedMetricsSet(splitList(viper.GetString("metrics_denylist")), splitList(viper.GetString("metrics_allowlist"))); err != nil {
+		return err
+	}
+	if _, err := buildSeriesTTL(splitList(viper.GetString("metrics_series_ttl"))); err != nil {
+		return err
+	}
+	dropped, err := buildDroppedLabels(splitList(viper.GetString("metrics_drop_labels")))
+	if err != nil {
+		return err
+	}
+	if _, err := buildTopN(splitList(viper.GetString("metrics_top_n")), dropped); err != nil {
+		return err
+	}
+	if _, err := buildStaticLabels(splitList(viper.GetString("static_labels"))); err != nil {
+		return err
+	}
+	if _, err := loadRelabelRules(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkWindowTiming checks that windows of window seconds, fetched every
+// interval seconds once they're delay seconds old, line up: either the
+// interval divides the window or the window the interval, so cycles fetch
+// windows at a steady pace. currentTimeWindow keeps every window within
+// now - delay.
+func checkWindowTiming(window int, interval int, delay int) error {
+	if window < 60 || window%60 != 0 {
+		return errors.New("WINDOW must be a multiple of 60 seconds")
+	}
+	if interval < 1 {
+		return errors.New("COLLECT_INTERVAL must be at least 1 second")
+	}
+	if delay < 0 {
+		return errors.New("SCRAPE_DELAY must not be negative")
+	}
+	if window%interval != 0 && interval%window != 0 {
+		return errors.New("COLLECT_INTERVAL must divide WINDOW or be a multiple of it")
+	}
+	return nil
+}
+
+// splitList splits a comma delimited setting, an empty setting is an empty
+// list.
+func splitList(s string) []string {
+	if len(s) == 0 {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// toggledDatasets lists the datasets that can be disabled, one per fetcher.
+func toggledDatasets() []string {
+	var datasets []string
+	for _, f := range accountFetchers {
+		datasets = append(datasets, f.dataset)
+	}
+	for _, f := range zoneFetchers {
+		datasets = append(datasets, f.dataset)
+	}
+	return datasets
+}
+
+func datasetDisabled(dataset string) bool {
+	return contains(splitList(viper.GetString("disabled_datasets")), dataset)
+}
+
+// buildStaticLabels parses name=value pairs added to every Cloudflare metric.
+func buildStaticLabels(pairs []string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for _, pair := range pairs {
+		name, value, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("static label %s must be in name=value format", pair)
+		}
+		if !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("static label name %s is invalid", name)
+		}
+		if name == tenantLabel {
+			return nil, fmt.Errorf("static label %s clashes with the tenant label", name)
+		}
+		for _, def := range metricDefs {
+			if contains(def.labels, name) {
+				return nil, fmt.Errorf("static label %s clashes with a label of %s", name, def.name)
+			}
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// configReloader re-reads the config file on SIGHUP or when it changes. A
+// reload waits for the running collection cycle, so a cycle always sees one
+// consistent configuration. Invalid files are rejected and the previous
+// configuration is kept.
+type configReloader struct {
+	path  string
+	cycle *sync.Mutex
+
+	applied map[string]interface{}
+	trigger chan struct{}
+}
+
+func newConfigReloader(path string, cycle *sync.Mutex, applied map[string]interface{}) *configReloader {
+	return &configReloader{
+		path:    path,
+		cycle:   cycle,
+		applied: applied,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// run reloads the config file on every trigger until ctx is cancelled.
+func (r *configReloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	watcher := viper.New()
+	watcher.SetConfigFile(r.path)
+	watcher.OnConfigChange(func(fsnotify.Event) { r.request() })
+	watcher.WatchConfig()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reload()
+		case <-r.trigger:
+			r.reload()
+		}
+	}
+}
+
+// request asks for a reload, coalescing the burst of events a single save
+// can cause.
+func (r *configReloader) request() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (r *configReloader) reload() {
+	r.cycle.Lock()
+	defer r.cycle.Unlock()
+
+	before := map[string]interface{}{}
+	for _, key := range staticSettings {
+		before[key] = viper.Get(key)
+	}
+
+	settings, err := readConfigFile(r.path)
+	if err == nil {
+		err = applyConfigSettings(settings)
+	}
+	if err == nil {
+		err = validateConfig()
+	}
+	if err == nil {
+		err = storeRelabelRules()
+	}
+	if err != nil {
+		log.Error("failed to reload config file, keeping the previous configuration: ", err)
+		exporterConfigReloads.With(prometheus.Labels{"result": "failure"}).Inc()
+		if err := applyConfigSettings(r.applied); err != nil {
+			log.Error("failed to restore the previous configuration: ", err)
+		}
+		return
+	}
+	r.applied = settings
+	if tenants, err := loadTenants(); err == nil {
+		retainTenants(tenants)
+	}
+
+	for _, key := range staticSettings {
+		if !reflect.DeepEqual(before[key], viper.Get(key)) {
+			log.Warn("config file changes ", key, ", restart the exporter to apply it")
+		}
+	}
+	log.Info("Reloaded config file ", r.path)
+	exporterConfigReloads.With(prometheus.Labels{"result": "success"}).Inc()
+}
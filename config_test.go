@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestCheckWindowTiming(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   int
+		interval int
+		delay    int
+		valid    bool
+	}{
+		{"defaults", 60, 60, 300, true},
+		{"five minute windows", 300, 300, 300, true},
+		{"interval divides window", 300, 60, 120, true},
+		{"window divides interval", 60, 300, 0, true},
+		{"window not in minutes", 90, 90, 300, false},
+		{"window below a minute", 30, 30, 300, false},
+		{"interval doesn't line up", 300, 120, 300, false},
+		{"window doesn't line up", 120, 300, 300, false},
+		{"no interval", 60, 0, 300, false},
+		{"negative delay", 60, 60, -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkWindowTiming(tt.window, tt.interval, tt.delay)
+			if (err == nil) != tt.valid {
+				t.Errorf("checkWindowTiming(%d, %d, %d) = %v, want valid %v", tt.window, tt.interval, tt.delay, err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestCurrentTimeWindow(t *testing.T) {
+	for _, tt := range []struct{ window, delay int }{{60, 300}, {300, 300}, {300, 0}, {600, 90}} {
+		viper.Set("window", tt.window)
+		viper.Set("scrape_delay", tt.delay)
+
+		before := time.Now()
+		w := currentTimeWindow()
+		if size := w.maxtime.Sub(w.mintime); size != time.Duration(tt.window)*time.Second {
+			t.Errorf("window %d: size = %v", tt.window, size)
+		}
+		if w.maxtime.After(before.Add(-time.Duration(tt.delay) * time.Second)) {
+			t.Errorf("window %d, delay %d: window ends at %v, past now - delay", tt.window, tt.delay, w.maxtime)
+		}
+		if w.maxtime.Unix()%int64(tt.window) != 0 {
+			t.Errorf("window %d: ends at %v, not aligned", tt.window, w.maxtime)
+		}
+	}
+	viper.Set("window", nil)
+	viper.Set("scrape_delay", nil)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+
+	"github.com/machinebox/graphql"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deniedMetrics are the metrics neither exported nor fetched, built at
+// startup from metrics_denylist and metrics_allowlist.
+var deniedMetrics = MetricsSet{}
+
+// nodeAliases maps the aliases used in GraphQL queries to the node they
+// query, as named in the zone and account settings.
+var nodeAliases = map[string]string{
+	"httpRequestsEdgeCountryHost": "httpRequestsAdaptiveGroups",
+	"healthCheckFailures":         "healthCheckEventsAdaptiveGroups",
+	"healthCheckEventsRtt":        "healthCheckEventsAdaptiveGroups",
+}
+
+func settingsNode(node string) string {
+	if n, ok := nodeAliases[node]; ok {
+		return n
+	}
+	return node
+}
+
+// datasetWanted reports whether dataset is enabled and any of its metrics is
+// exported. Datasets not wanted are never queried.
+func datasetWanted(dataset string) bool {
+	if datasetDisabled(dataset) {
+		return false
+	}
+	for _, def := range metricDefs {
+		if def.dataset == dataset && !deniedMetrics.Has(def.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeWanted reports whether any exported metric is computed from node, a
+// GraphQL node or alias queried for dataset.
+func nodeWanted(dataset string, node string) bool {
+	for _, def := range metricDefs {
+		if def.dataset == dataset && def.node == node && !deniedMetrics.Has(def.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyNodeWanted reports whether any of nodes is wanted, a query for none of
+// them would only fetch data nobody exports.
+func anyNodeWanted(dataset string, nodes ...string) bool {
+	for _, node := range nodes {
+		if nodeWanted(dataset, node) {
+			return true
+		}
+	}
+	return false
+}
+
+type disabledNodesContextKey struct{}
+
+// withDisabledNodes marks nodes as disabled for the zones or accounts queried
+// with ctx, see includeNodes.
+func withDisabledNodes(ctx context.Context, nodes []string) context.Context {
+	return context.WithValue(ctx, disabledNodesContextKey{}, nodes)
+}
+
+// includeNodes sets the Boolean variable named after each node, used by the
+// query's @include directives to leave out nodes no exported metric needs or
+// disabled for the queried zones or accounts.
+func includeNodes(ctx context.Context, request *graphql.Request, dataset string, nodes ...string) {
+	disabled, _ := ctx.Value(disabledNodesContextKey{}).([]string)
+	for _, node := range nodes {
+		request.Var(node, nodeWanted(dataset, node) && !contains(disabled, node))
+	}
+}
+
+// droppedLabels are the labels left out per metric, built at startup from
+// metrics_drop_labels. Values differing only in dropped labels are summed.
+var droppedLabels = map[MetricName][]string{}
+
+// exportedLabels returns the labels of def not dropped.
+func exportedLabels(def metricDef) []string {
+	var labels []string
+	for _, label := range def.labels {
+		if !contains(droppedLabels[def.name], label) {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// dropLabels returns a copy of labels without the ones dropped from the
+// metric, even if none are, so callers may share labels between metrics.
+func dropLabels(name MetricName, labels prometheus.Labels) prometheus.Labels {
+	dropped := droppedLabels[name]
+	kept := make(prometheus.Labels, len(labels)+1)
+	for label, value := range labels {
+		if !contains(dropped, label) {
+			kept[label] = value
+		}
+	}
+	return kept
+}
+
+// labelDimensions maps the GraphQL dimensions of grouped nodes onto the
+// label computed from them. A dimension is only requested when an exported
+// metric of the node keeps its label, so dropped labels narrow the
+// groups Cloudflare returns.
+var labelDimensions = []struct {
+	dataset   string
+	node      string
+	dimension string
+	label     string
+}{
+	{datasetZoneTotals, "firewallEventsAdaptiveGroups", "action", "action"},
+	{datasetZoneTotals, "firewallEventsAdaptiveGroups", "source", "source"},
+	{datasetZoneTotals, "firewallEventsAdaptiveGroups", "ruleId", "rule"},
+	{datasetZoneTotals, "firewallEventsAdaptiveGroups", "clientRequestHTTPHost", "host"},
+	{datasetZoneTotals, "firewallEventsAdaptiveGroups", "clientCountryName", "country"},
+	{datasetZoneTotals, "httpRequestsAdaptiveGroups", "originResponseStatus", "status"},
+	{datasetZoneTotals, "httpRequestsAdaptiveGroups", "clientCountryName", "country"},
+	{datasetZoneTotals, "httpRequestsAdaptiveGroups", "clientRequestHTTPHost", "host"},
+	{datasetZoneTotals, "httpRequestsEdgeCountryHost", "edgeResponseStatus", "status"},
+	{datasetZoneTotals, "httpRequestsEdgeCountryHost", "clientCountryName", "country"},
+	{datasetZoneTotals, "httpRequestsEdgeCountryHost", "clientRequestHTTPHost", "host"},
+	{datasetZoneTotals, "healthCheckEventsAdaptiveGroups", "healthStatus", "health_status"},
+	{datasetZoneTotals, "healthCheckEventsAdaptiveGroups", "originIP", "origin_ip"},
+	{datasetZoneTotals, "healthCheckEventsAdaptiveGroups", "region", "region"},
+	{datasetZoneTotals, "healthCheckEventsAdaptiveGroups", "fqdn", "fqdn"},
+	{datasetZoneTotals, "healthCheckFailures", "originIP", "origin_ip"},
+	{datasetZoneTotals, "healthCheckFailures", "region", "region"},
+	{datasetZoneTotals, "healthCheckFailures", "fqdn", "fqdn"},
+	{datasetZoneTotals, "healthCheckFailures", "failureReason", "failure_reason"},
+	{datasetZoneTotals, "healthCheckFailures", "originResponseStatus", "status"},
+	{datasetZoneTotals, "healthCheckEventsRtt", "originIP", "origin_ip"},
+	{datasetZoneTotals, "healthCheckEventsRtt", "region", "region"},
+	{datasetZoneTotals, "healthCheckEventsRtt", "fqdn", "fqdn"},
+	{datasetColocation, "httpRequestsAdaptiveGroups", "coloCode", "colocation"},
+	{datasetColocation, "httpRequestsAdaptiveGroups", "clientRequestHTTPHost", "host"},
+	{datasetWorkers, "workersInvocationsAdaptive", "status", "status"},
+	{datasetSubrequests, "workersSubrequestsAdaptiveGroups", "hostname", "host"},
+	{datasetSubrequests, "workersSubrequestsAdaptiveGroups", "cacheStatus", "cache_status"},
+	{datasetSubrequests, "workersSubrequestsAdaptiveGroups", "httpResponseStatus", "status"},
+	{datasetLoadBalancer, "loadBalancingRequestsAdaptiveGroups", "steeringPolicy", "steering_policy"},
+	{datasetLoadBalancer, "loadBalancingRequestsAdaptiveGroups", "sessionAffinityStatus", "session_affinity"},
+	{datasetLoadBalancer, "loadBalancingRequestsAdaptiveGroups", "proxied", "proxied"},
+}
+
+// labelKept reports whether an exported metric of node keeps label.
+func labelKept(dataset string, node string, label string) bool {
+	for _, def := range metricDefs {
+		if def.dataset == dataset && def.node == node && !deniedMetrics.Has(def.name) && contains(exportedLabels(def), label) {
+			return true
+		}
+	}
+	return false
+}
+
+// includeDimensions sets the Boolean variable named node_dimension of every
+// dimension of dataset's nodes, used by the query's @include directives.
+func includeDimensions(request *graphql.Request, dataset string) {
+	for _, d := range labelDimensions {
+		if d.dataset == dataset {
+			request.Var(d.node+"_"+d.dimension, labelKept(dataset, d.node, d.label))
+		}
+	}
+}
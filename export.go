@@ -0,0 +1,329 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// metricsModeCounter accumulates Cloudflare data into counters updated
+	// in the background, independent of scrapes.
+	metricsModeCounter = "counter"
+	// metricsModeWindow serves the most recently completed Cloudflare window
+	// on every scrape, timestamped with the end of the window.
+	metricsModeWindow = "window"
+)
+
+type metricSample struct {
+	name   MetricName
+	labels prometheus.Labels
+	value  float64
+	set    bool
+}
+
+// metricBatch collects the samples fetched during one collection cycle.
+// Samples added to a batch of a tenant are labeled with its name.
+type metricBatch struct {
+	mu      sync.Mutex
+	window  timeWindow
+	tenant  string
+	samples []metricSample
+}
+
+func newMetricBatch(w timeWindow) *metricBatch {
+	return &metricBatch{window: w}
+}
+
+func newTenantBatch(w timeWindow, t *tenant) *metricBatch {
+	return &metricBatch{window: w, tenant: t.Name}
+}
+
+// add adds value to a counter. Values of series differing only in dropped
+// labels add up.
+func (b *metricBatch) add(name MetricName, labels prometheus.Labels, value float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.samples = append(b.samples, metricSample{name: name, labels: b.withTenant(dropLabels(name, labels)), value: value})
+}
+
+// set sets a gauge to value.
+func (b *metricBatch) set(name MetricName, labels prometheus.Labels, value float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.samples = append(b.samples, metricSample{name: name, labels: b.withTenant(dropLabels(name, labels)), value: value, set: true})
+}
+
+// withTenant adds the tenant label to labels in place, they must be the copy
+// made by dropLabels.
+func (b *metricBatch) withTenant(labels prometheus.Labels) prometheus.Labels {
+	labels[tenantLabel] = b.tenant
+	return labels
+}
+
+// otherLabelValue replaces the label values folded by topN.
+const otherLabelValue = "__other__"
+
+// topN is the number of values kept per ranked label of a metric, built at
+// startup from metrics_top_n.
+var topN = map[MetricName]map[string]int{}
+
+// foldTopN ranks the values of every topN label by the sum of the metric
+// within each zone or account, keeps the top ones and folds the others into
+// __other__, so totals still add up. Call it once all samples of a window
+// were added.
+func (b *metricBatch) foldTopN() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for name, labels := range topN {
+		for label, n := range labels {
+			totals := map[string]map[string]float64{}
+			for _, s := range b.samples {
+				if s.name != name || s.set {
+					continue
+				}
+				scope := topNScope(s.labels)
+				if totals[scope] == nil {
+					totals[scope] = map[string]float64{}
+				}
+				totals[scope][s.labels[label]] += s.value
+			}
+
+			kept := map[string]map[string]bool{}
+			for scope, values := range totals {
+				kept[scope] = topValues(values, n)
+			}
+
+			for i, s := range b.samples {
+				if s.name != name || s.set || kept[topNScope(s.labels)][s.labels[label]] {
+					continue
+				}
+				folded := prometheus.Labels{}
+				for k, v := range s.labels {
+					folded[k] = v
+				}
+				folded[label] = otherLabelValue
+				b.samples[i].labels = folded
+			}
+		}
+	}
+}
+
+func topNScope(labels prometheus.Labels) string {
+	return labels[tenantLabel] + "/" + labels["account"] + "/" + labels["zone"]
+}
+
+// topValues returns the n values with the largest totals, ties broken by
+// value so the ranking is stable.
+func topValues(totals map[string]float64, n int) map[string]bool {
+	values := make([]string, 0, len(totals))
+	for v := range totals {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if totals[values[i]] != totals[values[j]] {
+			return totals[values[i]] > totals[values[j]]
+		}
+		return values[i] < values[j]
+	})
+
+	kept := map[string]bool{}
+	for _, v := range values[:min(n, len(values))] {
+		kept[v] = true
+	}
+	return kept
+}
+
+// merge appends the samples of other to b.
+func (b *metricBatch) merge(other *metricBatch) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.samples = append(b.samples, other.samples...)
+}
+
+// metricsExporter publishes the batch of a finished collection cycle.
+type metricsExporter interface {
+	export(b *metricBatch)
+}
+
+// metricVecs holds a vec per exported metric, denied metrics have none.
+type metricVecs map[MetricName]prometheus.Collector
+
+// newMetricVecs creates vecs for metrics not in denied. With asGauges,
+// counters are created as gauges holding the value of a single window.
+func newMetricVecs(denied MetricsSet, asGauges bool) metricVecs {
+	vecs := metricVecs{}
+	for _, def := range metricDefs {
+		if denied.Has(def.name) {
+			continue
+		}
+		labels := append(exportedLabels(def), tenantLabel)
+		if def.valueType == prometheus.CounterValue && !asGauges {
+			vecs[def.name] = prometheus.NewCounterVec(prometheus.CounterOpts{
+				Name: def.name.String(),
+				Help: def.help,
+			}, labels)
+		} else {
+			vecs[def.name] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: def.name.String(),
+				Help: def.help,
+			}, labels)
+		}
+	}
+	return vecs
+}
+
+func (vecs metricVecs) export(b *metricBatch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, s := range b.samples {
+		switch vec := vecs[s.name].(type) {
+		case *prometheus.CounterVec:
+			vec.With(s.labels).Add(s.value)
+		case *prometheus.GaugeVec:
+			if s.set {
+				vec.With(s.labels).Set(s.value)
+			} else {
+				vec.With(s.labels).Add(s.value)
+			}
+		}
+	}
+}
+
+// counterExporter adds batches to cumulative vecs. Series of metrics with a
+// TTL are deleted once they weren't updated for that many windows.
+type counterExporter struct {
+	vecs metricVecs
+	ttl  map[MetricName]int
+
+	mu         sync.Mutex
+	windows    int
+	lastUpdate map[MetricName]map[string]seriesUpdate
+}
+
+type seriesUpdate struct {
+	labels prometheus.Labels
+	window int
+}
+
+func newCounterExporter(vecs metricVecs, ttl map[MetricName]int) *counterExporter {
+	return &counterExporter{
+		vecs:       vecs,
+		ttl:        ttl,
+		lastUpdate: map[MetricName]map[string]seriesUpdate{},
+	}
+}
+
+func (e *counterExporter) export(b *metricBatch) {
+	e.vecs.export(b)
+
+	if len(e.ttl) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.windows++
+
+	b.mu.Lock()
+	for _, s := range b.samples {
+		if _, ok := e.ttl[s.name]; !ok {
+			continue
+		}
+		if e.lastUpdate[s.name] == nil {
+			e.lastUpdate[s.name] = map[string]seriesUpdate{}
+		}
+		e.lastUpdate[s.name][seriesKey(s.labels)] = seriesUpdate{labels: s.labels, window: e.windows}
+	}
+	b.mu.Unlock()
+
+	for name, ttl := range e.ttl {
+		vec, ok := e.vecs[name].(interface{ Delete(prometheus.Labels) bool })
+		if !ok {
+			continue
+		}
+		expired := 0
+		for key, u := range e.lastUpdate[name] {
+			if e.windows-u.window >= ttl {
+				vec.Delete(u.labels)
+				delete(e.lastUpdate[name], key)
+				expired++
+			}
+		}
+		if expired > 0 {
+			log.Debug("expired ", expired, " series of ", name)
+			exporterSeriesExpired.With(prometheus.Labels{"metric": name.String()}).Add(float64(expired))
+		}
+	}
+}
+
+// seriesKey identifies a series of a metric by its label values.
+func seriesKey(labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte(0xfe)
+		key.WriteString(labels[name])
+		key.WriteByte(0xff)
+	}
+	return key.String()
+}
+
+// windowCollector serves the samples of the last exported batch. Every
+// series is timestamped with the end of the batch's window, and series
+// missing from the batch are no longer exported.
+type windowCollector struct {
+	denied MetricsSet
+
+	mu     sync.RWMutex
+	window timeWindow
+	vecs   metricVecs
+}
+
+func newWindowCollector(denied MetricsSet) *windowCollector {
+	return &windowCollector{denied: denied}
+}
+
+func (c *windowCollector) export(b *metricBatch) {
+	vecs := newMetricVecs(c.denied, true)
+	vecs.export(b)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.window = b.window
+	c.vecs = vecs
+}
+
+// Describe sends no descriptors, which makes windowCollector an unchecked
+// collector. Its series change with every window.
+func (c *windowCollector) Describe(_ chan<- *prometheus.Desc) {}
+
+func (c *windowCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		for _, vec := range c.vecs {
+			vec.Collect(metrics)
+		}
+		close(metrics)
+	}()
+
+	for m := range metrics {
+		ch <- prometheus.NewMetricWithTimestamp(c.window.maxtime, m)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTopValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		totals map[string]float64
+		n      int
+		want   map[string]bool
+	}{
+		{
+			name:   "largest totals",
+			totals: map[string]float64{"US": 10, "DE": 30, "SK": 20, "FR": 5},
+			n:      2,
+			want:   map[string]bool{"DE": true, "SK": true},
+		},
+		{
+			name:   "ties broken by value",
+			totals: map[string]float64{"US": 10, "DE": 10, "SK": 10, "AT": 1},
+			n:      2,
+			want:   map[string]bool{"DE": true, "SK": true},
+		},
+		{
+			name:   "fewer values than n",
+			totals: map[string]float64{"US": 1},
+			n:      3,
+			want:   map[string]bool{"US": true},
+		},
+		{
+			name:   "no values",
+			totals: map[string]float64{},
+			n:      3,
+			want:   map[string]bool{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := topValues(tt.totals, tt.n); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("topValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFoldTopN(t *testing.T) {
+	type sample struct {
+		zone    string
+		country string
+		value   float64
+	}
+	tests := []struct {
+		name    string
+		n       int
+		samples []sample
+		want    map[string]map[string]float64
+	}{
+		{
+			name: "ranked per zone",
+			n:    1,
+			samples: []sample{
+				{"a.com", "US", 10}, {"a.com", "DE", 5}, {"a.com", "SK", 1},
+				{"b.com", "US", 1}, {"b.com", "DE", 7},
+			},
+			want: map[string]map[string]float64{
+				"a.com": {"US": 10, otherLabelValue: 6},
+				"b.com": {"DE": 7, otherLabelValue: 1},
+			},
+		},
+		{
+			name: "ranked by the sum of every series of a value",
+			n:    1,
+			samples: []sample{
+				{"a.com", "US", 4}, {"a.com", "US", 4}, {"a.com", "DE", 6},
+			},
+			want: map[string]map[string]float64{
+				"a.com": {"US": 8, otherLabelValue: 6},
+			},
+		},
+		{
+			name: "ties broken by value",
+			n:    2,
+			samples: []sample{
+				{"a.com", "US", 3}, {"a.com", "DE", 3}, {"a.com", "AT", 3}, {"a.com", "SK", 3},
+			},
+			want: map[string]map[string]float64{
+				"a.com": {"AT": 3, "DE": 3, otherLabelValue: 6},
+			},
+		},
+		{
+			name: "nothing folded within n",
+			n:    5,
+			samples: []sample{
+				{"a.com", "US", 1}, {"a.com", "DE", 2},
+			},
+			want: map[string]map[string]float64{
+				"a.com": {"US": 1, "DE": 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topN = map[MetricName]map[string]int{zoneRequestCountryMetricName: {"country": tt.n}}
+			defer func() { topN = map[MetricName]map[string]int{} }()
+
+			b := newTenantBatch(timeWindow{}, &tenant{Name: "default"})
+			var total float64
+			for _, s := range tt.samples {
+				b.add(zoneRequestCountryMetricName, prometheus.Labels{"zone": s.zone, "account": "acc", "country": s.country}, s.value)
+				total += s.value
+			}
+			b.set(zoneRequestCountryMetricName, prometheus.Labels{"zone": "a.com", "account": "acc", "country": "gauge"}, 100)
+			b.foldTopN()
+
+			got := map[string]map[string]float64{}
+			var folded float64
+			for _, s := range b.samples {
+				if s.set {
+					if s.labels["country"] != "gauge" {
+						t.Errorf("gauge sample folded into %s", s.labels["country"])
+					}
+					continue
+				}
+				if got[s.labels["zone"]] == nil {
+					got[s.labels["zone"]] = map[string]float64{}
+				}
+				got[s.labels["zone"]][s.labels["country"]] += s.value
+				folded += s.value
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("foldTopN() = %v, want %v", got, tt.want)
+			}
+			if folded != total {
+				t.Errorf("total after folding = %v, want %v", folded, total)
+			}
+		})
+	}
+}
+
+func TestMetricBatchKeepsCallerLabels(t *testing.T) {
+	droppedLabels = map[MetricName][]string{zoneRequestCountryMetricName: {"country"}}
+	defer func() { droppedLabels = map[MetricName][]string{} }()
+
+	labels := prometheus.Labels{"zone": "a.com", "account": "acc", "country": "US"}
+	b := newTenantBatch(timeWindow{}, &tenant{Name: "default"})
+	b.add(zoneRequestCountryMetricName, labels, 1)
+	b.add(zoneRequestTotalMetricName, labels, 1)
+	b.set(zoneRequestTotalMetricName, labels, 1)
+
+	want := prometheus.Labels{"zone": "a.com", "account": "acc", "country": "US"}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("caller's labels = %v, want %v", labels, want)
+	}
+	for _, s := range b.samples {
+		if s.labels[tenantLabel] != "default" {
+			t.Errorf("%s has no tenant label: %v", s.name, s.labels)
+		}
+	}
+}
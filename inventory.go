@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+// cfInventories caches the zones, accounts, firewall rule descriptions,
+// health checks and worker scripts fetched from the REST API per tenant,
+// shared by all collection cycles.
+var cfInventories = &inventories{byTenant: map[string]*inventory{}}
+
+var inventoryAgeDesc = prometheus.NewDesc(
+	"cloudflare_exporter_inventory_age_seconds",
+	"Time since the inventory was last refreshed from the Cloudflare REST API, the oldest zone or account for per zone or account kinds",
+	[]string{"kind", tenantLabel}, nil,
+)
+
+type inventories struct {
+	mu       sync.Mutex
+	byTenant map[string]*inventory
+}
+
+// inventoryFor returns the inventory of the tenant of ctx.
+func inventoryFor(ctx context.Context) *inventory {
+	name := tenantFromContext(ctx).Name
+
+	cfInventories.mu.Lock()
+	defer cfInventories.mu.Unlock()
+	inv, ok := cfInventories.byTenant[name]
+	if !ok {
+		inv = newInventory()
+		cfInventories.byTenant[name] = inv
+	}
+	return inv
+}
+
+// retain drops the inventories of tenants not in names.
+func (i *inventories) retain(names map[string]bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for name := range i.byTenant {
+		if !names[name] {
+			delete(i.byTenant, name)
+		}
+	}
+}
+
+// Describe sends no descriptors, kinds never fetched have no age.
+func (i *inventories) Describe(_ chan<- *prometheus.Desc) {}
+
+func (i *inventories) Collect(ch chan<- prometheus.Metric) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for name, inv := range i.byTenant {
+		inv.collect(ch, name)
+	}
+}
+
+// inventory refreshes each kind of REST data once it's older than
+// inventory_ttl. When a refresh fails, the stale data is returned along with
+// the error, so collection carries on with what is known.
+type inventory struct {
+	// refresh serializes refreshes of zones and accounts, mu guards the
+	// fields and is never held while talking to Cloudflare.
+	refresh    sync.Mutex
+	mu         sync.Mutex
+	zones      []cloudflare.Zone
+	zonesAt    time.Time
+	zonesOf    string
+	accounts   []cloudflare.Account
+	accountsAt time.Time
+	rules      map[string]*scopedEntry[map[string]string]
+	checks     map[string]*scopedEntry[[]cloudflare.Healthcheck]
+	scripts    map[string]*scopedEntry[[]cloudflare.WorkerMetaData]
+	caps       *capabilities
+}
+
+// scopedEntry holds REST data of a zone or account. Each is refreshed
+// independently, under its own lock.
+type scopedEntry[T any] struct {
+	mu       sync.Mutex
+	value    T
+	failedAt time.Time
+	// at is read by Collect without taking mu, which is held while fetching.
+	at atomic.Int64
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		rules:   map[string]*scopedEntry[map[string]string]{},
+		checks:  map[string]*scopedEntry[[]cloudflare.Healthcheck]{},
+		scripts: map[string]*scopedEntry[[]cloudflare.WorkerMetaData]{},
+		caps:    &capabilities{entries: map[string]capabilityEntry{}},
+	}
+}
+
+func inventoryExpired(at time.Time) bool {
+	return time.Since(at) >= time.Duration(viper.GetInt("inventory_ttl"))*time.Second
+}
+
+// listZones returns the zones of accountIDs, or all zones if accountIDs is
+// nil. The cache is refreshed early when the accounts change.
+func (inv *inventory) listZones(ctx context.Context, accountIDs []string) ([]cloudflare.Zone, error) {
+	inv.refresh.Lock()
+	defer inv.refresh.Unlock()
+
+	of := "*"
+	if accountIDs != nil {
+		of = strings.Join(accountIDs, ",")
+	}
+
+	inv.mu.Lock()
+	cached, at, cachedOf := inv.zones, inv.zonesAt, inv.zonesOf
+	inv.mu.Unlock()
+	if cachedOf == of && !inventoryExpired(at) {
+		return cached, nil
+	}
+
+	zones, err := fetchZones(ctx, accountIDs)
+	if err != nil {
+		if cachedOf != of {
+			return nil, err
+		}
+		return cached, err
+	}
+	inv.mu.Lock()
+	inv.zones, inv.zonesAt, inv.zonesOf = zones, time.Now(), of
+	inv.mu.Unlock()
+	return zones, nil
+}
+
+func (inv *inventory) listAccounts(ctx context.Context) ([]cloudflare.Account, error) {
+	inv.refresh.Lock()
+	defer inv.refresh.Unlock()
+
+	inv.mu.Lock()
+	cached, at := inv.accounts, inv.accountsAt
+	inv.mu.Unlock()
+	if !inventoryExpired(at) {
+		return cached, nil
+	}
+
+	accounts, err := fetchAccounts(ctx)
+	if err != nil {
+		return cached, err
+	}
+	inv.mu.Lock()
+	inv.accounts, inv.accountsAt = accounts, time.Now()
+	inv.mu.Unlock()
+	return accounts, nil
+}
+
+// firewallRules returns the rule descriptions of the zone keyed by rule ID.
+func (inv *inventory) firewallRules(ctx context.Context, zoneID string) (map[string]string, error) {
+	return cachedFor(inv, inv.rules, zoneID, func() (map[string]string, error) {
+		return fetchFirewallRules(ctx, zoneID)
+	})
+}
+
+// healthChecks returns the standalone health checks of the zone.
+func (inv *inventory) healthChecks(ctx context.Context, zoneID string) ([]cloudflare.Healthcheck, error) {
+	return cachedFor(inv, inv.checks, zoneID, func() ([]cloudflare.Healthcheck, error) {
+		return fetchHealthChecks(ctx, zoneID)
+	})
+}
+
+// workerScripts returns the worker scripts of the account.
+func (inv *inventory) workerScripts(ctx context.Context, accountID string) ([]cloudflare.WorkerMetaData, error) {
+	return cachedFor(inv, inv.scripts, accountID, func() ([]cloudflare.WorkerMetaData, error) {
+		return fetchWorkerScripts(ctx, accountID)
+	})
+}
+
+// cachedFor returns the entry of the zone or account id in entries, fetched
+// again once it's older than inventory_ttl. A failed fetch isn't retried for
+// inventory_ttl either, so a token lacking a permission costs one request and
+// one error per zone or account and TTL rather than per window. Until then the
+// previous value is returned without error.
+func cachedFor[T any](inv *inventory, entries map[string]*scopedEntry[T], id string, fetch func() (T, error)) (T, error) {
+	inv.mu.Lock()
+	entry, ok := entries[id]
+	if !ok {
+		entry = &scopedEntry[T]{}
+		entries[id] = entry
+	}
+	inv.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if !inventoryExpired(time.Unix(0, entry.at.Load())) || !inventoryExpired(entry.failedAt) {
+		return entry.value, nil
+	}
+	value, err := fetch()
+	if err != nil {
+		// Keep the previous value, a partial result is only better than
+		// nothing.
+		if entry.at.Load() == 0 {
+			entry.value = value
+		}
+		entry.failedAt = time.Now()
+		return entry.value, err
+	}
+	entry.value = value
+	entry.at.Store(time.Now().UnixNano())
+	return value, nil
+}
+
+// oldestEntry returns when the least recently refreshed entry was fetched.
+func oldestEntry[T any](entries map[string]*scopedEntry[T]) time.Time {
+	var oldest time.Time
+	for _, entry := range entries {
+		if at := entry.at.Load(); at != 0 && (oldest.IsZero() || time.Unix(0, at).Before(oldest)) {
+			oldest = time.Unix(0, at)
+		}
+	}
+	return oldest
+}
+
+func (inv *inventory) collect(ch chan<- prometheus.Metric, tenant string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if !inv.zonesAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(inventoryAgeDesc, prometheus.GaugeValue, time.Since(inv.zonesAt).Seconds(), "zones", tenant)
+	}
+	if !inv.accountsAt.IsZero() {
+		ch <- prometheus.MustNewConstMetric(inventoryAgeDesc, prometheus.GaugeValue, time.Since(inv.accountsAt).Seconds(), "accounts", tenant)
+	}
+
+	if oldest := oldestEntry(inv.rules); !oldest.IsZero() {
+		ch <- prometheus.MustNewConstMetric(inventoryAgeDesc, prometheus.GaugeValue, time.Since(oldest).Seconds(), "firewall_rules", tenant)
+	}
+	if oldest := oldestEntry(inv.checks); !oldest.IsZero() {
+		ch <- prometheus.MustNewConstMetric(inventoryAgeDesc, prometheus.GaugeValue, time.Since(oldest).Seconds(), "health_checks", tenant)
+	}
+	if oldest := oldestEntry(inv.scripts); !oldest.IsZero() {
+		ch <- prometheus.MustNewConstMetric(inventoryAgeDesc, prometheus.GaugeValue, time.Since(oldest).Seconds(), "worker_scripts", tenant)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+
+	"github.com/spf13/viper"
+)
+
+func TestCachedFor(t *testing.T) {
+	viper.Set("inventory_ttl", 3600)
+	defer viper.Set("inventory_ttl", nil)
+
+	tests := []struct {
+		name      string
+		results   []error
+		wantCalls int
+		wantErrs  int
+	}{
+		{"success is cached", []error{nil}, 1, 0},
+		{"failure is cached", []error{errors.New("forbidden")}, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := newInventory()
+			calls, errs := 0, 0
+			for i := 0; i < 5; i++ {
+				_, err := cachedFor(inv, inv.checks, "zone", func() ([]cloudflare.Healthcheck, error) {
+					err := tt.results[min(calls, len(tt.results)-1)]
+					calls++
+					return nil, err
+				})
+				if err != nil {
+					errs++
+				}
+			}
+			if calls != tt.wantCalls || errs != tt.wantErrs {
+				t.Errorf("fetched %d times with %d errors, want %d and %d", calls, errs, tt.wantCalls, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func TestRetainTenants(t *testing.T) {
+	defer func() { cfInventories.byTenant = map[string]*inventory{} }()
+	for _, name := range []string{"kept", "removed"} {
+		inventoryFor(withTenant(context.Background(), &tenant{Name: name}))
+	}
+
+	retainTenants([]*tenant{{Name: "kept"}})
+	if _, ok := cfInventories.byTenant["removed"]; ok {
+		t.Error("inventory of removed tenant retained")
+	}
+	if _, ok := cfInventories.byTenant["kept"]; !ok {
+		t.Error("inventory of kept tenant dropped")
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/nelkinda/health-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -102,35 +107,293 @@ func filterExcludedZones(all []cloudflare.Zone, exclude []string) []cloudflare.Z
 	return filtered
 }
 
-func fetchMetrics() {
-	var wg sync.WaitGroup
-	zones := fetchZones()
-	accounts := fetchAccounts()
-	filteredZones := filterExcludedZones(filterZones(zones, getTargetZones()), getExcludedZones())
+// filterAccounts returns the accounts selected by ID or name in target, all
+// of them if target is empty, minus those in exclude.
+func filterAccounts(all []cloudflare.Account, target []string, exclude []string) []cloudflare.Account {
+	var filtered []cloudflare.Account
 
-	for _, a := range accounts {
-		go fetchWorkerAnalytics(a, &wg)
-		go fetchLogpushAnalyticsForAccount(a, &wg)
+	for _, a := range all {
+		if len(target) > 0 && !contains(target, a.ID) && !contains(target, a.Name) {
+			continue
+		}
+		if contains(exclude, a.ID) || contains(exclude, a.Name) {
+			log.Info("Exclude account: ", a.ID, " ", a.Name)
+			continue
+		}
+		filtered = append(filtered, a)
+	}
+
+	return filtered
+}
+
+// accountSelected reports whether t restricts the accounts it collects.
+func accountSelected(t *tenant) bool {
+	return len(t.Accounts) > 0 || len(t.ExcludeAccounts) > 0
+}
+
+type accountFetcher struct {
+	dataset string
+	fetch   func(ctx context.Context, account cloudflare.Account, w timeWindow, b *metricBatch) error
+}
+
+type zoneFetcher struct {
+	dataset string
+	fetch   func(ctx context.Context, zones []cloudflare.Zone, w timeWindow, b *metricBatch) error
+}
+
+var accountFetchers = []accountFetcher{
+	{datasetWorkers, fetchWorkerAnalytics},
+	{datasetSubrequests, fetchWorkerSubrequestAnalytics},
+	{datasetScheduled, fetchWorkerScheduledAnalytics},
+	{datasetQueues, fetchQueueAnalytics},
+	{datasetLogpushAccount, fetchLogpushAnalyticsForAccount},
+}
+
+var zoneFetchers = []zoneFetcher{
+	{datasetZoneTotals, fetchZoneAnalytics},
+	{datasetColocation, fetchZoneColocationAnalytics},
+	{datasetLoadBalancer, fetchLoadBalancerAnalytics},
+	{datasetLogpushZone, fetchLogpushAnalyticsForZone},
+}
+
+// fetchMetrics runs one collection cycle. Failed API calls are logged and
+// counted, the cycle carries on with whatever data is available. Windows
+// missed since the last checkpoint of a dataset are fetched first, up to
+// maxWindows including the current one.
+func fetchMetrics(ctx context.Context, exporter metricsExporter, cps *checkpoints, maxWindows int) {
+	failed := false
+	listed := true
+
+	start := time.Now()
+	defer func() {
+		exporterCollectionDuration.Observe(time.Since(start).Seconds())
+	}()
+	windows := backfillWindows(currentTimeWindow(), maxWindows)
+
+	tenants, err := loadTenants()
+	if err != nil {
+		log.Error("failed to load tenants: ", err)
+		exporterUp.Set(0)
+		return
+	}
+
+	var scopes []tenantScope
+	for _, t := range tenants {
+		ctx := withTenant(ctx, t)
+		accounts, err := inventoryFor(ctx).listAccounts(ctx)
+		if err != nil {
+			log.Error("failed to list accounts of tenant ", t.Name, ": ", err)
+			recordScrapeError(ctx, datasetAccounts, "", "")
+			failed = true
+			listed = false
+		}
+		accounts = filterAccounts(accounts, t.Accounts, t.ExcludeAccounts)
+
+		// Zones are only discovered in the selected accounts, all zones
+		// the credentials can see are listed at once otherwise.
+		var accountIDs []string
+		if accountSelected(t) {
+			accountIDs = []string{}
+			for _, a := range accounts {
+				accountIDs = append(accountIDs, a.ID)
+			}
+		}
+		zones, err := inventoryFor(ctx).listZones(ctx, accountIDs)
+		if err != nil {
+			log.Error("failed to list zones of tenant ", t.Name, ": ", err)
+			recordScrapeError(ctx, datasetZones, "", "")
+			failed = true
+			listed = false
+		}
+		selection, err := newZoneSelection(t)
+		if err != nil {
+			log.Error("invalid zone selection of tenant ", t.Name, ": ", err)
+			exporterUp.Set(0)
+			return
+		}
+		zones = selection.filter(filterExcludedZones(filterZones(zones, t.Zones), t.ExcludeZones))
+
+		caps := inventoryFor(ctx).caps
+		if err := caps.probe(ctx, zones, accounts); err != nil {
+			log.Error("failed to detect datasets available to tenant ", t.Name, ": ", err)
+			recordScrapeError(ctx, datasetCapabilities, "", "")
+			failed = true
+		}
+		scopes = append(scopes, tenantScope{
+			tenant:   t,
+			accounts: accounts,
+			zones:    zones,
+			caps:     caps,
+		})
+	}
+	recordSelectedZones(scopes)
+	recordDatasetAvailability(scopes)
+	// Checkpoints of zones and accounts no longer selected are dropped, unless
+	// an inventory couldn't be listed and some may only be missing this cycle.
+	if listed {
+		cps.retain(checkpointKeys(scopes))
 	}
 
-	// Make requests in groups of cfgBatchSize to avoid rate limit
-	// 10 is the maximum amount of zones you can request at once
-	for len(filteredZones) > 0 {
-		sliceLength := viper.GetInt("cf_batch_size")
-		if len(filteredZones) < viper.GetInt("cf_batch_size") {
-			sliceLength = len(filteredZones)
+	for i, w := range windows {
+		if ctx.Err() != nil {
+			break
+		}
+		b := newMetricBatch(w)
+		var jobs []func(ctx context.Context) error
+		for _, scope := range scopes {
+			jobs = append(jobs, windowJobs(cps, windows, i, scope, b)...)
+		}
+		if len(jobs) == 0 {
+			continue
+		}
+		if i < len(windows)-1 {
+			log.Info("backfilling window ", w.mintime.Format(time.RFC3339), " for ", len(jobs), " queries")
+			exporterBackfilledWindows.Inc()
+		}
+
+		if runJobs(ctx, viper.GetInt("cf_concurrency"), jobs) {
+			failed = true
 		}
+		exporter.export(b)
 
-		targetZones := filteredZones[:sliceLength]
-		filteredZones = filteredZones[len(targetZones):]
+		if err := cps.save(); err != nil {
+			log.Error("failed to save checkpoints: ", err)
+		}
+	}
 
-		go fetchZoneAnalytics(targetZones, &wg)
-		go fetchZoneColocationAnalytics(targetZones, &wg)
-		go fetchLoadBalancerAnalytics(targetZones, &wg)
-		go fetchLogpushAnalyticsForZone(targetZones, &wg)
+	if failed {
+		exporterUp.Set(0)
+	} else {
+		exporterUp.Set(1)
 	}
+}
+
+// tenantScope holds the accounts and selected zones of a tenant, and the
+// datasets each of them can be queried for.
+type tenantScope struct {
+	tenant   *tenant
+	accounts []cloudflare.Account
+	zones    []cloudflare.Zone
+	caps     *capabilities
+}
 
-	wg.Wait()
+// checkpointKeys returns the checkpoint keys of every dataset of the
+// tenants' selected accounts and zones.
+func checkpointKeys(scopes []tenantScope) map[string]bool {
+	keys := map[string]bool{}
+	for _, scope := range scopes {
+		for _, f := range accountFetchers {
+			for _, a := range scope.accounts {
+				keys[checkpointKey(scope.tenant.Name, f.dataset, a.ID)] = true
+			}
+		}
+		for _, f := range zoneFetchers {
+			for _, z := range scope.zones {
+				keys[checkpointKey(scope.tenant.Name, f.dataset, z.ID)] = true
+			}
+		}
+	}
+	return keys
+}
+
+// windowJobs builds the queries of window i for the tenant's accounts and
+// zones whose checkpoint needs it. Every job fetches into its own batch,
+// merged into b only on success, so a window retried later is never counted
+// twice.
+func windowJobs(cps *checkpoints, windows []timeWindow, i int, scope tenantScope, b *metricBatch) []func(ctx context.Context) error {
+	var jobs []func(ctx context.Context) error
+	w := windows[i]
+	t := scope.tenant
+
+	job := func(keys []string, disabled []string, fetch func(ctx context.Context, jb *metricBatch) error) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			ctx = withDisabledNodes(withTenant(ctx, t), disabled)
+			jb := newTenantBatch(w, t)
+			if err := fetch(ctx, jb); err != nil {
+				return err
+			}
+			jb.foldTopN()
+			b.merge(jb)
+			cps.advance(keys, w)
+			return nil
+		}
+	}
+
+	for _, f := range accountFetchers {
+		f := f
+		if !datasetWanted(f.dataset) {
+			continue
+		}
+		for _, a := range scope.accounts {
+			a := a
+			key := checkpointKey(t.Name, f.dataset, a.ID)
+			if !scope.caps.available(a.ID, f.dataset) || !cps.needs(key, windows, i) {
+				continue
+			}
+			warnSkippedWindows(cps, key, windows, i)
+			jobs = append(jobs, job([]string{key}, scope.caps.disabledNodes(a.ID, f.dataset), func(ctx context.Context, jb *metricBatch) error {
+				return f.fetch(ctx, a, w, jb)
+			}))
+		}
+	}
+
+	for _, f := range zoneFetchers {
+		f := f
+		if !datasetWanted(f.dataset) {
+			continue
+		}
+		// Zones are batched with the zones missing the same nodes, the
+		// batch's queries leave these nodes out.
+		var groups [][]cloudflare.Zone
+		groupOf := map[string]int{}
+		for _, z := range scope.zones {
+			key := checkpointKey(t.Name, f.dataset, z.ID)
+			if !scope.caps.available(z.ID, f.dataset) || !cps.needs(key, windows, i) {
+				continue
+			}
+			warnSkippedWindows(cps, key, windows, i)
+			nodes := strings.Join(scope.caps.disabledNodes(z.ID, f.dataset), ",")
+			g, ok := groupOf[nodes]
+			if !ok {
+				g = len(groups)
+				groupOf[nodes] = g
+				groups = append(groups, nil)
+			}
+			groups[g] = append(groups[g], z)
+		}
+
+		for _, pending := range groups {
+			disabled := scope.caps.disabledNodes(pending[0].ID, f.dataset)
+
+			// Make requests in groups of cfgBatchSize to avoid rate limit
+			// 10 is the maximum amount of zones you can request at once
+			for len(pending) > 0 {
+				sliceLength := viper.GetInt("cf_batch_size")
+				if len(pending) < viper.GetInt("cf_batch_size") {
+					sliceLength = len(pending)
+				}
+
+				targetZones := pending[:sliceLength]
+				pending = pending[len(targetZones):]
+
+				keys := make([]string, 0, len(targetZones))
+				for _, z := range targetZones {
+					keys = append(keys, checkpointKey(t.Name, f.dataset, z.ID))
+				}
+				jobs = append(jobs, job(keys, disabled, func(ctx context.Context, jb *metricBatch) error {
+					return f.fetch(ctx, targetZones, w, jb)
+				}))
+			}
+		}
+	}
+
+	return jobs
+}
+
+func warnSkippedWindows(cps *checkpoints, key string, windows []timeWindow, i int) {
+	if i == 0 && cps.behind(key, windows[0]) {
+		log.Warn(key, " is more than ", len(windows), " windows behind, older windows are skipped")
+	}
 }
 
 func runExpoter() {
@@ -143,33 +406,92 @@ func runExpoter() {
 
 	// fmt.Println(" :", cfgListen)
 
+	var configSettings map[string]interface{}
+	if len(viper.GetString("config")) > 0 {
+		var err error
+		configSettings, err = readConfigFile(viper.GetString("config"))
+		if err != nil {
+			log.Fatal("failed to read config file: ", err)
+		}
+		if err := applyConfigSettings(configSettings); err != nil {
+			log.Fatal("failed to read config file: ", err)
+		}
+	}
 	cfgMetricsPath := viper.GetString("metrics_path")
 
-	if !(len(viper.GetString("cf_api_token")) > 0 || (len(viper.GetString("cf_api_email")) > 0 && len(viper.GetString("cf_api_key")) > 0)) {
-		log.Fatal("Please provide CF_API_KEY+CF_API_EMAIL or CF_API_TOKEN")
+	if err := validateConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := storeRelabelRules(); err != nil {
+		log.Fatal(err)
+	}
+	if viper.GetInt("collect_interval") != viper.GetInt("window") {
+		log.Warn("COLLECT_INTERVAL differs from WINDOW, cycles either find no new window or fetch several windows")
 	}
-	if viper.GetInt("cf_batch_size") < 1 || viper.GetInt("cf_batch_size") > 10 {
-		log.Fatal("CF_BATCH_SIZE must be between 1 and 10")
+	if viper.GetBool("free_tier") {
+		log.Warn("FREE_TIER is deprecated and ignored, the datasets available to each zone are detected")
 	}
 	customFormatter := new(log.TextFormatter)
 	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
 	log.SetFormatter(customFormatter)
 	customFormatter.FullTimestamp = true
 
-	metricsDenylist := []string{}
-	if len(viper.GetString("metrics_denylist")) > 0 {
-		metricsDenylist = strings.Split(viper.GetString("metrics_denylist"), ",")
+	denied, err := buildDeniedMetricsSet(splitList(viper.GetString("metrics_denylist")), splitList(viper.GetString("metrics_allowlist")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	deniedMetrics = denied
+	dropped, err := buildDroppedLabels(splitList(viper.GetString("metrics_drop_labels")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	droppedLabels = dropped
+	ranked, err := buildTopN(splitList(viper.GetString("metrics_top_n")), droppedLabels)
+	if err != nil {
+		log.Fatal(err)
 	}
-	deniedMetricsSet, err := buildDeniedMetricsSet(metricsDenylist)
+	topN = ranked
+	seriesTTL, err := buildSeriesTTL(splitList(viper.GetString("metrics_series_ttl")))
 	if err != nil {
 		log.Fatal(err)
 	}
-	mustRegisterMetrics(deniedMetricsSet)
+	staticLabels, err := buildStaticLabels(splitList(viper.GetString("static_labels")))
+	if err != nil {
+		log.Fatal(err)
+	}
+	exporter := mustRegisterMetrics(deniedMetrics, viper.GetString("metrics_mode"), seriesTTL, staticLabels)
+
+	// A window mode scrape only serves the current window, so there is nothing
+	// to backfill.
+	maxWindows := viper.GetInt("backfill_max_windows")
+	stateFile := viper.GetString("state_file")
+	if viper.GetString("metrics_mode") == metricsModeWindow {
+		maxWindows = 1
+		stateFile = ""
+	}
+	cps, err := loadCheckpoints(stateFile)
+	if err != nil {
+		log.Fatal("failed to load state file: ", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Config reloads wait for the running cycle and cycles for the reload.
+	var cycle sync.Mutex
+	if len(viper.GetString("config")) > 0 {
+		go newConfigReloader(viper.GetString("config"), &cycle, configSettings).run(ctx)
+	}
 
+	collector := newScheduler(time.Duration(viper.GetInt("collect_interval"))*time.Second, func(ctx context.Context) {
+		cycle.Lock()
+		defer cycle.Unlock()
+		fetchMetrics(ctx, exporter, cps, maxWindows)
+	})
+	collectorDone := make(chan struct{})
 	go func() {
-		for ; true; <-time.NewTicker(60 * time.Second).C {
-			go fetchMetrics()
-		}
+		collector.run(ctx)
+		close(collectorDone)
 	}()
 
 	// This section will start the HTTP server and expose
@@ -178,7 +500,13 @@ func runExpoter() {
 		cfgMetricsPath = "/" + viper.GetString("metrics_path")
 	}
 
-	http.Handle(cfgMetricsPath, promhttp.Handler())
+	http.Handle(cfgMetricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.Gatherers{
+			prometheus.DefaultGatherer,
+			relabelGatherer{next: cloudflareRegistry, rules: &relabelRules},
+		}, promhttp.HandlerOpts{}),
+	))
 	h := health.New(health.Health{})
 	http.HandleFunc("/health", h.Handler)
 
@@ -189,7 +517,18 @@ func runExpoter() {
 		ReadHeaderTimeout: 3 * time.Second,
 	}
 
-	log.Fatal(server.ListenAndServe())
+	go func() {
+		<-ctx.Done()
+		log.Info("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-collectorDone
 }
 
 func main() {
@@ -206,6 +545,9 @@ func main() {
 
 	flags := cmd.Flags()
 
+	flags.String("config", "", "YAML or TOML config file, reloaded on SIGHUP or change; flags and environment variables take precedence")
+	viper.BindEnv("config")
+
 	flags.String("listen", ":8080", "listen on addr:port ( default :8080), omit addr to listen on all interfaces")
 	viper.BindEnv("listen")
 	viper.SetDefault("listen", ":8080")
@@ -223,6 +565,18 @@ func main() {
 	flags.String("cf_api_token", "", "cloudflare api token (preferred)")
 	viper.BindEnv("cf_api_token")
 
+	flags.String("tenant", "default", "value of the tenant label when the config file defines no tenants")
+	viper.BindEnv("tenant")
+	viper.SetDefault("tenant", "default")
+
+	flags.String("cf_api_base_url", cfAPIBaseURL, "cloudflare REST API base url")
+	viper.BindEnv("cf_api_base_url")
+	viper.SetDefault("cf_api_base_url", cfAPIBaseURL)
+
+	flags.String("cf_graphql_endpoint", cfGraphQLEndpoint, "cloudflare GraphQL API endpoint")
+	viper.BindEnv("cf_graphql_endpoint")
+	viper.SetDefault("cf_graphql_endpoint", cfGraphQLEndpoint)
+
 	flags.String("cf_zones", "", "cloudflare zones to export, comma delimited list")
 	viper.BindEnv("cf_zones")
 	viper.SetDefault("cf_zones", "")
@@ -231,22 +585,118 @@ func main() {
 	viper.BindEnv("cf_exclude_zones")
 	viper.SetDefault("cf_exclude_zones", "")
 
+	flags.String("cf_accounts", "", "cloudflare accounts to export, comma delimited list of ids or names")
+	viper.BindEnv("cf_accounts")
+	viper.SetDefault("cf_accounts", "")
+
+	flags.String("cf_exclude_accounts", "", "cloudflare accounts to exclude, comma delimited list of ids or names")
+	viper.BindEnv("cf_exclude_accounts")
+	viper.SetDefault("cf_exclude_accounts", "")
+
+	flags.String("cf_zone_names", "", "cloudflare zone names to export, comma delimited list of globs or ~regexes")
+	viper.BindEnv("cf_zone_names")
+	viper.SetDefault("cf_zone_names", "")
+
+	flags.String("cf_exclude_zone_names", "", "cloudflare zone names to exclude, comma delimited list of globs or ~regexes")
+	viper.BindEnv("cf_exclude_zone_names")
+	viper.SetDefault("cf_exclude_zone_names", "")
+
+	flags.String("cf_zone_plans", "", "cloudflare zone plans to export, comma delimited list of free, pro, business, enterprise")
+	viper.BindEnv("cf_zone_plans")
+	viper.SetDefault("cf_zone_plans", "")
+
+	flags.String("cf_zone_status", "", "cloudflare zone statuses to export, comma delimited list, e.g. active,pending")
+	viper.BindEnv("cf_zone_status")
+	viper.SetDefault("cf_zone_status", "")
+
+	flags.String("cf_zone_paused", "", "export only paused zones if true, only unpaused zones if false, both if empty")
+	viper.BindEnv("cf_zone_paused")
+	viper.SetDefault("cf_zone_paused", "")
+
 	flags.Int("scrape_delay", 300, "scrape delay in seconds, defaults to 300")
 	viper.BindEnv("scrape_delay")
 	viper.SetDefault("scrape_delay", 300)
 
+	flags.Int("cf_timeout", 30, "timeout of a single cloudflare API request in seconds")
+	viper.BindEnv("cf_timeout")
+	viper.SetDefault("cf_timeout", 30)
+
+	flags.Int("cf_max_retries", 3, "retries of cloudflare API requests failing with a network error, 429 or 5xx")
+	viper.BindEnv("cf_max_retries")
+	viper.SetDefault("cf_max_retries", 3)
+
+	flags.Float64("cf_graphql_rps", 1, "cloudflare GraphQL API requests per second per tenant, 0 for unlimited")
+	viper.BindEnv("cf_graphql_rps")
+	viper.SetDefault("cf_graphql_rps", 1)
+
+	flags.Float64("cf_rest_rps", 4, "cloudflare REST API requests per second per tenant, 0 for unlimited")
+	viper.BindEnv("cf_rest_rps")
+	viper.SetDefault("cf_rest_rps", 4)
+
+	flags.Int("inventory_ttl", 600, "seconds zones, accounts and firewall rule descriptions are cached for, defaults to 600")
+	viper.BindEnv("inventory_ttl")
+	viper.SetDefault("inventory_ttl", 600)
+
+	flags.Int("collect_interval", 60, "seconds between collection cycles, defaults to 60")
+	viper.BindEnv("collect_interval")
+	viper.SetDefault("collect_interval", 60)
+
+	flags.Int("window", 60, "seconds of cloudflare data fetched per query, a multiple of 60, defaults to 60")
+	viper.BindEnv("window")
+	viper.SetDefault("window", 60)
+
 	flags.Int("cf_batch_size", 10, "cloudflare zones batch size (1-10), defaults to 10")
 	viper.BindEnv("cf_batch_size")
 	viper.SetDefault("cf_batch_size", 10)
 
-	flags.Bool("free_tier", false, "scrape only metrics included in free plan")
+	flags.Int("cf_concurrency", 4, "maximum number of concurrent cloudflare API queries, defaults to 4")
+	viper.BindEnv("cf_concurrency")
+	viper.SetDefault("cf_concurrency", 4)
+
+	flags.Bool("free_tier", false, "deprecated and ignored, the datasets available to each zone are detected")
 	viper.BindEnv("free_tier")
 	viper.SetDefault("free_tier", false)
 
+	flags.String("disabled_datasets", "", "datasets to not fetch, comma delimited list")
+	viper.BindEnv("disabled_datasets")
+	viper.SetDefault("disabled_datasets", "")
+
+	flags.String("static_labels", "", "labels added to every cloudflare metric, comma delimited list of name=value")
+	viper.BindEnv("static_labels")
+	viper.SetDefault("static_labels", "")
+
 	flags.String("metrics_denylist", "", "metrics to not expose, comma delimited list")
 	viper.BindEnv("metrics_denylist")
 	viper.SetDefault("metrics_denylist", "")
 
+	flags.String("metrics_drop_labels", "", "labels to drop per metric, summing the values, comma delimited list of metric=label|label")
+	viper.BindEnv("metrics_drop_labels")
+	viper.SetDefault("metrics_drop_labels", "")
+
+	flags.String("metrics_top_n", "", "label values kept per window, the others folded into __other__, comma delimited list of metric=label:n|label:n")
+	viper.BindEnv("metrics_top_n")
+	viper.SetDefault("metrics_top_n", "")
+
+	flags.String("metrics_allowlist", "", "metrics to expose, comma delimited list, all if empty")
+	viper.BindEnv("metrics_allowlist")
+	viper.SetDefault("metrics_allowlist", "")
+
+	flags.String("state_file", "", "file to persist the last fetched window per dataset in, kept in memory only if empty")
+	viper.BindEnv("state_file")
+	viper.SetDefault("state_file", "")
+
+	flags.Int("backfill_max_windows", 15, "maximum number of windows, including the current one, fetched per cycle to catch up after a restart or stall")
+	viper.BindEnv("backfill_max_windows")
+	viper.SetDefault("backfill_max_windows", 15)
+
+	flags.String("metrics_series_ttl", "", "delete series not updated for a number of windows, comma delimited list of metric=windows")
+	viper.BindEnv("metrics_series_ttl")
+	viper.SetDefault("metrics_series_ttl", "")
+
+	flags.String("metrics_mode", metricsModeCounter, "counter to accumulate cloudflare data into counters, window to export the last cloudflare window on each scrape")
+	viper.BindEnv("metrics_mode")
+	viper.SetDefault("metrics_mode", metricsModeCounter)
+
 	viper.BindPFlags(flags)
 	cmd.Execute()
 }
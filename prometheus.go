@@ -1,15 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
-	"sync"
 
 	"github.com/biter777/countries"
 	cloudflare "github.com/cloudflare/cloudflare-go"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/spf13/viper"
+	log "github.com/sirupsen/logrus"
 )
 
 type MetricName string
@@ -26,6 +26,9 @@ const (
 	zoneRequestCountryMetricName                 MetricName = "cloudflare_zone_requests_country"
 	zoneRequestHTTPStatusMetricName              MetricName = "cloudflare_zone_requests_status"
 	zoneRequestBrowserMapMetricName              MetricName = "cloudflare_zone_requests_browser_map_page_views_count"
+	zoneRequestHTTPProtocolMetricName            MetricName = "cloudflare_zone_requests_http_protocol"
+	zoneRequestTLSVersionMetricName              MetricName = "cloudflare_zone_requests_tls_version"
+	zoneRequestIPClassMetricName                 MetricName = "cloudflare_zone_requests_ip_class"
 	zoneRequestOriginStatusCountryHostMetricName MetricName = "cloudflare_zone_requests_origin_status_country_host"
 	zoneRequestStatusCountryHostMetricName       MetricName = "cloudflare_zone_requests_status_country_host"
 	zoneBandwidthTotalMetricName                 MetricName = "cloudflare_zone_bandwidth_total"
@@ -43,12 +46,25 @@ const (
 	zoneColocationRequestsTotalMetricName        MetricName = "cloudflare_zone_colocation_requests_total"
 	zoneFirewallEventsCountMetricName            MetricName = "cloudflare_zone_firewall_events_count"
 	zoneHealthCheckEventsOriginCountMetricName   MetricName = "cloudflare_zone_health_check_events_origin_count"
+	zoneHealthCheckFailuresCountMetricName       MetricName = "cloudflare_zone_health_check_failures_count"
+	zoneHealthCheckRTTMetricName                 MetricName = "cloudflare_zone_health_check_rtt_seconds"
+	zoneHealthCheckInfoMetricName                MetricName = "cloudflare_zone_health_check_info"
 	workerRequestsMetricName                     MetricName = "cloudflare_worker_requests_count"
 	workerErrorsMetricName                       MetricName = "cloudflare_worker_errors_count"
 	workerCPUTimeMetricName                      MetricName = "cloudflare_worker_cpu_time"
 	workerDurationMetricName                     MetricName = "cloudflare_worker_duration"
+	workerScriptInfoMetricName                   MetricName = "cloudflare_worker_script_info"
+	workerSubrequestsMetricName                  MetricName = "cloudflare_worker_subrequests_count"
+	workerScheduledInvocationsMetricName         MetricName = "cloudflare_worker_scheduled_invocations_count"
+	workerScheduledCPUTimeMetricName             MetricName = "cloudflare_worker_scheduled_cpu_seconds_total"
+	queueConsumerConcurrencyMetricName           MetricName = "cloudflare_queue_consumer_concurrency"
+	queueBacklogMessagesMetricName               MetricName = "cloudflare_queue_backlog_messages"
+	queueBacklogBytesMetricName                  MetricName = "cloudflare_queue_backlog_bytes"
 	poolHealthStatusMetricName                   MetricName = "cloudflare_zone_pool_health_status"
 	poolRequestsTotalMetricName                  MetricName = "cloudflare_zone_pool_requests_total"
+	poolAvgRTTMetricName                         MetricName = "cloudflare_zone_pool_avg_rtt_seconds"
+	poolOriginHealthStatusMetricName             MetricName = "cloudflare_zone_pool_origin_health_status"
+	loadBalancerRequestsTotalMetricName          MetricName = "cloudflare_zone_load_balancer_requests_total"
 	logpushFailedJobsAccountMetricName           MetricName = "cloudflare_logpush_failed_jobs_account_count"
 	logpushFailedJobsZoneMetricName              MetricName = "cloudflare_logpush_failed_jobs_zone_count"
 )
@@ -64,551 +80,1236 @@ func (ms MetricsSet) Add(mn MetricName) {
 	ms[mn] = struct{}{}
 }
 
-var (
-	// Requests
-	zoneRequestTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneRequestTotalMetricName.String(),
-		Help: "Number of requests for zone",
-	}, []string{"zone", "account"},
-	)
-
-	zoneRequestCached = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneRequestCachedMetricName.String(),
-		Help: "Number of cached requests for zone",
-	}, []string{"zone", "account"},
-	)
-
-	zoneRequestSSLEncrypted = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneRequestSSLEncryptedMetricName.String(),
-		Help: "Number of encrypted requests for zone",
-	}, []string{"zone", "account"},
-	)
-
-	zoneRequestContentType = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneRequestContentTypeMetricName.String(),
-		Help: "Number of request for zone per content type",
-	}, []string{"zone", "account", "content_type"},
-	)
-
-	zoneRequestCountry = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneRequestCountryMetricName.String(),
-		Help: "Number of request for zone per country",
-	}, []string{"zone", "account", "country", "region"},
-	)
-
-	zoneRequestHTTPStatus = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneRequestHTTPStatusMetricName.String(),
-		Help: "Number of request for zone per HTTP status",
-	}, []string{"zone", "account", "status"},
-	)
-
-	zoneRequestBrowserMap = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneRequestBrowserMapMetricName.String(),
-		Help: "Number of successful requests for HTML pages per zone",
-	}, []string{"zone", "account", "family"},
-	)
-
-	zoneRequestOriginStatusCountryHost = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneRequestOriginStatusCountryHostMetricName.String(),
-		Help: "Count of not cached requests for zone per origin HTTP status per country per host",
-	}, []string{"zone", "account", "status", "country", "host"},
-	)
-
-	zoneRequestStatusCountryHost = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneRequestStatusCountryHostMetricName.String(),
-		Help: "Count of requests for zone per edge HTTP status per country per host",
-	}, []string{"zone", "account", "status", "country", "host"},
-	)
-
-	zoneBandwidthTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneBandwidthTotalMetricName.String(),
-		Help: "Total bandwidth per zone in bytes",
-	}, []string{"zone", "account"},
-	)
-
-	zoneBandwidthCached = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneBandwidthCachedMetricName.String(),
-		Help: "Cached bandwidth per zone in bytes",
-	}, []string{"zone", "account"},
-	)
-
-	zoneBandwidthSSLEncrypted = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneBandwidthSSLEncryptedMetricName.String(),
-		Help: "Encrypted bandwidth per zone in bytes",
-	}, []string{"zone", "account"},
-	)
-
-	zoneBandwidthContentType = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneBandwidthContentTypeMetricName.String(),
-		Help: "Bandwidth per zone per content type",
-	}, []string{"zone", "account", "content_type"},
-	)
-
-	zoneBandwidthCountry = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneBandwidthCountryMetricName.String(),
-		Help: "Bandwidth per country per zone",
-	}, []string{"zone", "account", "country", "region"},
-	)
-
-	zoneThreatsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneThreatsTotalMetricName.String(),
-		Help: "Threats per zone",
-	}, []string{"zone", "account"},
-	)
-
-	zoneThreatsCountry = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneThreatsCountryMetricName.String(),
-		Help: "Threats per zone per country",
-	}, []string{"zone", "account", "country", "region"},
-	)
-
-	zoneThreatsType = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneThreatsTypeMetricName.String(),
-		Help: "Threats per zone per type",
-	}, []string{"zone", "account", "type"},
-	)
+// metricDef describes a metric exported from Cloudflare analytics data, and
+// the dataset and GraphQL node, or alias, it is computed from. Metrics read
+// from the REST API along with a dataset have no node.
+type metricDef struct {
+	name      MetricName
+	dataset   string
+	node      string
+	help      string
+	labels    []string
+	valueType prometheus.ValueType
+}
 
-	zonePageviewsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zonePageviewsTotalMetricName.String(),
-		Help: "Pageviews per zone",
-	}, []string{"zone", "account"},
-	)
+var metricDefs = []metricDef{
+	{
+		name:      zoneRequestTotalMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Number of requests for zone",
+		labels:    []string{"zone", "account"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestCachedMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Number of cached requests for zone",
+		labels:    []string{"zone", "account"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestSSLEncryptedMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Number of encrypted requests for zone",
+		labels:    []string{"zone", "account"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestContentTypeMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Number of request for zone per content type",
+		labels:    []string{"zone", "account", "content_type"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestCountryMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Number of request for zone per country",
+		labels:    []string{"zone", "account", "country", "region"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestHTTPStatusMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Number of request for zone per HTTP status",
+		labels:    []string{"zone", "account", "status"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestBrowserMapMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Number of successful requests for HTML pages per zone",
+		labels:    []string{"zone", "account", "family"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestHTTPProtocolMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Number of requests for zone per HTTP protocol",
+		labels:    []string{"zone", "account", "protocol"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestTLSVersionMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Number of requests for zone per TLS version, none for plain HTTP",
+		labels:    []string{"zone", "account", "tls_version"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestIPClassMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Number of requests for zone per client IP class",
+		labels:    []string{"zone", "account", "ip_class"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestOriginStatusCountryHostMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequestsAdaptiveGroups",
+		help:      "Count of not cached requests for zone per origin HTTP status per country per host",
+		labels:    []string{"zone", "account", "status", "country", "host"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneRequestStatusCountryHostMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequestsEdgeCountryHost",
+		help:      "Count of requests for zone per edge HTTP status per country per host",
+		labels:    []string{"zone", "account", "status", "country", "host"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneBandwidthTotalMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Total bandwidth per zone in bytes",
+		labels:    []string{"zone", "account"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneBandwidthCachedMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Cached bandwidth per zone in bytes",
+		labels:    []string{"zone", "account"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneBandwidthSSLEncryptedMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Encrypted bandwidth per zone in bytes",
+		labels:    []string{"zone", "account"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneBandwidthContentTypeMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Bandwidth per zone per content type",
+		labels:    []string{"zone", "account", "content_type"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneBandwidthCountryMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Bandwidth per country per zone",
+		labels:    []string{"zone", "account", "country", "region"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneThreatsTotalMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Threats per zone",
+		labels:    []string{"zone", "account"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneThreatsCountryMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Threats per zone per country",
+		labels:    []string{"zone", "account", "country", "region"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneThreatsTypeMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Threats per zone per type",
+		labels:    []string{"zone", "account", "type"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zonePageviewsTotalMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Pageviews per zone",
+		labels:    []string{"zone", "account"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneUniquesTotalMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "httpRequests1mGroups",
+		help:      "Uniques per zone",
+		labels:    []string{"zone", "account"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneColocationVisitsMetricName,
+		dataset:   datasetColocation,
+		node:      "httpRequestsAdaptiveGroups",
+		help:      "Total visits per colocation",
+		labels:    []string{"zone", "account", "colocation", "host"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneColocationEdgeResponseBytesMetricName,
+		dataset:   datasetColocation,
+		node:      "httpRequestsAdaptiveGroups",
+		help:      "Edge response bytes per colocation",
+		labels:    []string{"zone", "account", "colocation", "host"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneColocationRequestsTotalMetricName,
+		dataset:   datasetColocation,
+		node:      "httpRequestsAdaptiveGroups",
+		help:      "Total requests per colocation",
+		labels:    []string{"zone", "account", "colocation", "host"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneFirewallEventsCountMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "firewallEventsAdaptiveGroups",
+		help:      "Count of Firewall events",
+		labels:    []string{"zone", "account", "action", "source", "rule", "host", "country"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneHealthCheckEventsOriginCountMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "healthCheckEventsAdaptiveGroups",
+		help:      "Number of Heath check events per region per origin",
+		labels:    []string{"zone", "account", "health_status", "origin_ip", "region", "fqdn"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneHealthCheckFailuresCountMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "healthCheckFailures",
+		help:      "Number of failed health checks per origin per failure reason and origin response status",
+		labels:    []string{"zone", "account", "origin_ip", "region", "fqdn", "failure_reason", "status"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      zoneHealthCheckRTTMetricName,
+		dataset:   datasetZoneTotals,
+		node:      "healthCheckEventsRtt",
+		help:      "Round trip time quantiles of health checks per region per origin in seconds",
+		labels:    []string{"zone", "account", "origin_ip", "region", "fqdn", "quantile"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      zoneHealthCheckInfoMetricName,
+		dataset:   datasetZoneTotals,
+		help:      "Standalone health checks configured per zone, with their target as fqdn and current status",
+		labels:    []string{"zone", "account", "name", "fqdn", "type", "interval", "status", "failure_reason"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      workerRequestsMetricName,
+		dataset:   datasetWorkers,
+		node:      "workersInvocationsAdaptive",
+		help:      "Number of requests sent to worker by script name and invocation status",
+		labels:    []string{"script_name", "account", "status"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      workerErrorsMetricName,
+		dataset:   datasetWorkers,
+		node:      "workersInvocationsAdaptive",
+		help:      "Number of errors by script name and invocation status",
+		labels:    []string{"script_name", "account", "status"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      workerCPUTimeMetricName,
+		dataset:   datasetWorkers,
+		node:      "workersInvocationsAdaptive",
+		help:      "CPU time quantiles by script name and invocation status",
+		labels:    []string{"script_name", "account", "status", "quantile"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      workerDurationMetricName,
+		dataset:   datasetWorkers,
+		node:      "workersInvocationsAdaptive",
+		help:      "Duration quantiles by script name and invocation status (GB*s)",
+		labels:    []string{"script_name", "account", "status", "quantile"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      workerScriptInfoMetricName,
+		dataset:   datasetWorkers,
+		help:      "Worker scripts of the account with their deployment and version",
+		labels:    []string{"script_name", "account", "deployment_id", "etag", "deployed_from"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      workerSubrequestsMetricName,
+		dataset:   datasetSubrequests,
+		node:      "workersSubrequestsAdaptiveGroups",
+		help:      "Number of subrequests by script name per host, cache status and HTTP status",
+		labels:    []string{"script_name", "account", "host", "cache_status", "status"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      workerScheduledInvocationsMetricName,
+		dataset:   datasetScheduled,
+		node:      "workersInvocationsScheduled",
+		help:      "Number of scheduled invocations by script name per cron and status",
+		labels:    []string{"script_name", "account", "cron", "status"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      workerScheduledCPUTimeMetricName,
+		dataset:   datasetScheduled,
+		node:      "workersInvocationsScheduled",
+		help:      "CPU time of scheduled invocations by script name per cron and status in seconds",
+		labels:    []string{"script_name", "account", "cron", "status"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      queueConsumerConcurrencyMetricName,
+		dataset:   datasetQueues,
+		node:      "queueConsumerMetricsAdaptiveGroups",
+		help:      "Average number of concurrent consumer invocations per queue by script name",
+		labels:    []string{"script_name", "account", "queue_id"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      queueBacklogMessagesMetricName,
+		dataset:   datasetQueues,
+		node:      "queueBacklogAdaptiveGroups",
+		help:      "Average number of messages in the backlog per queue",
+		labels:    []string{"account", "queue_id"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      queueBacklogBytesMetricName,
+		dataset:   datasetQueues,
+		node:      "queueBacklogAdaptiveGroups",
+		help:      "Average size of the backlog per queue in bytes",
+		labels:    []string{"account", "queue_id"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      poolHealthStatusMetricName,
+		dataset:   datasetLoadBalancer,
+		node:      "loadBalancingRequestsAdaptive",
+		help:      "Reports the health of a pool, 1 for healthy, 0 for unhealthy.",
+		labels:    []string{"zone", "account", "load_balancer_name", "pool_name"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      poolRequestsTotalMetricName,
+		dataset:   datasetLoadBalancer,
+		node:      "loadBalancingRequestsAdaptiveGroups",
+		help:      "Requests per pool",
+		labels:    []string{"zone", "account", "load_balancer_name", "pool_name", "origin_name"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      poolAvgRTTMetricName,
+		dataset:   datasetLoadBalancer,
+		node:      "loadBalancingRequestsAdaptive",
+		help:      "Average round trip time to a pool from a region in seconds",
+		labels:    []string{"zone", "account", "load_balancer_name", "pool_name", "region"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      poolOriginHealthStatusMetricName,
+		dataset:   datasetLoadBalancer,
+		node:      "loadBalancingRequestsAdaptive",
+		help:      "Reports the health of an origin of a pool, 1 for healthy, 0 for unhealthy",
+		labels:    []string{"zone", "account", "load_balancer_name", "pool_name", "origin_name", "origin_ip"},
+		valueType: prometheus.GaugeValue,
+	},
+	{
+		name:      loadBalancerRequestsTotalMetricName,
+		dataset:   datasetLoadBalancer,
+		node:      "loadBalancingRequestsAdaptiveGroups",
+		help:      "Requests per load balancer per steering policy, session affinity status and proxied flag",
+		labels:    []string{"zone", "account", "load_balancer_name", "steering_policy", "session_affinity", "proxied"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      logpushFailedJobsAccountMetricName,
+		dataset:   datasetLogpushAccount,
+		node:      "logpushHealthAdaptiveGroups",
+		help:      "Number of failed logpush jobs on the account level",
+		labels:    []string{"account", "destination", "job_id", "final"},
+		valueType: prometheus.CounterValue,
+	},
+	{
+		name:      logpushFailedJobsZoneMetricName,
+		dataset:   datasetLogpushZone,
+		node:      "logpushHealthAdaptiveGroups",
+		help:      "Number of failed logpush jobs on the zone level",
+		labels:    []string{"destination", "job_id", "final"},
+		valueType: prometheus.CounterValue,
+	},
+}
 
-	zoneUniquesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneUniquesTotalMetricName.String(),
-		Help: "Uniques per zone",
-	}, []string{"zone", "account"},
-	)
+// cloudflareRegistry holds the Cloudflare metrics, the only ones relabel
+// configs apply to.
+var cloudflareRegistry = prometheus.NewRegistry()
 
-	zoneColocationVisits = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneColocationVisitsMetricName.String(),
-		Help: "Total visits per colocation",
-	}, []string{"zone", "account", "colocation", "host"},
+var (
+	// Exporter
+	exporterUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cloudflare_exporter_up",
+		Help: "Whether the last collection from the Cloudflare API succeeded, 1 for success, 0 if any call failed",
+	})
+
+	exporterScrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudflare_exporter_scrape_errors_total",
+		Help: "Number of failed Cloudflare API calls per dataset",
+	}, []string{"dataset", "zone", "account", tenantLabel},
 	)
 
-	zoneColocationEdgeResponseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneColocationEdgeResponseBytesMetricName.String(),
-		Help: "Edge response bytes per colocation",
-	}, []string{"zone", "account", "colocation", "host"},
+	exporterAPIRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cloudflare_exporter_api_request_duration_seconds",
+		Help:    "Latency of Cloudflare API calls per API and dataset",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"api", "dataset"},
 	)
 
-	zoneColocationRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneColocationRequestsTotalMetricName.String(),
-		Help: "Total requests per colocation",
-	}, []string{"zone", "account", "colocation", "host"},
+	exporterAPIResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cloudflare_exporter_api_response_size_bytes",
+		Help:    "Size of Cloudflare API responses per API and dataset",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 9),
+	}, []string{"api", "dataset"},
 	)
 
-	zoneFirewallEventsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneFirewallEventsCountMetricName.String(),
-		Help: "Count of Firewall events",
-	}, []string{"zone", "account", "action", "source", "rule", "host", "country"},
+	exporterGraphQLRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudflare_exporter_graphql_rows_total",
+		Help: "Number of rows returned per GraphQL dataset",
+	}, []string{"dataset"},
 	)
 
-	zoneHealthCheckEventsOriginCount = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: zoneHealthCheckEventsOriginCountMetricName.String(),
-		Help: "Number of Heath check events per region per origin",
-	}, []string{"zone", "account", "health_status", "origin_ip", "region", "fqdn"},
+	exporterCollectionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "cloudflare_exporter_collection_duration_seconds",
+		Help:    "Duration of a collection cycle fetching all datasets",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+
+	exporterSkippedCycles = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cloudflare_exporter_skipped_cycles_total",
+		Help: "Number of collection cycles skipped because the previous cycle was still running",
+	})
+
+	exporterGraphQLTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudflare_exporter_graphql_truncated_total",
+		Help: "Number of GraphQL results per dataset and zone that hit the row limit even after splitting the query",
+	}, []string{"dataset", "zone", "account", tenantLabel},
 	)
 
-	workerRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: workerRequestsMetricName.String(),
-		Help: "Number of requests sent to worker by script name",
-	}, []string{"script_name", "account"},
+	exporterConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudflare_exporter_config_reloads_total",
+		Help: "Number of config file reloads per result, success or failure",
+	}, []string{"result"},
 	)
 
-	workerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: workerErrorsMetricName.String(),
-		Help: "Number of errors by script name",
-	}, []string{"script_name", "account"},
+	exporterAPIRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudflare_exporter_api_retries_total",
+		Help: "Number of retried Cloudflare API calls per API, dataset and reason",
+	}, []string{"api", "dataset", "reason"},
 	)
 
-	workerCPUTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: workerCPUTimeMetricName.String(),
-		Help: "CPU time quantiles by script name",
-	}, []string{"script_name", "account", "quantile"},
+	exporterAPIThrottleWait = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudflare_exporter_api_throttle_wait_seconds_total",
+		Help: "Time Cloudflare API calls waited for the rate limiter or a Retry-After response header",
+	}, []string{"api", "source"},
 	)
 
-	workerDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: workerDurationMetricName.String(),
-		Help: "Duration quantiles by script name (GB*s)",
-	}, []string{"script_name", "account", "quantile"},
-	)
+	exporterBackfilledWindows = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cloudflare_exporter_backfilled_windows_total",
+		Help: "Number of past windows fetched to catch up after a restart or stall",
+	})
 
-	poolHealthStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: poolHealthStatusMetricName.String(),
-		Help: "Reports the health of a pool, 1 for healthy, 0 for unhealthy.",
-	},
-		[]string{"zone", "account", "load_balancer_name", "pool_name"},
+	exporterSeriesExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cloudflare_exporter_series_expired_total",
+		Help: "Number of series deleted after not being updated for their TTL",
+	}, []string{"metric"},
 	)
 
-	poolRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: poolRequestsTotalMetricName.String(),
-		Help: "Requests per pool",
-	},
-		[]string{"zone", "account", "load_balancer_name", "pool_name", "origin_name"},
+	exporterSelectedZones = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cloudflare_exporter_selected_zone_info",
+		Help: "Zones matching the zone selection, collected in the last cycle",
+	}, []string{"zone", "zone_id", "account", "plan", "status", "paused", tenantLabel},
 	)
 
-	// TODO: Update this to counter vec and use counts from the query to add
-	logpushFailedJobsAccount = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: logpushFailedJobsAccountMetricName.String(),
-		Help: "Number of failed logpush jobs on the account level",
-	},
-		[]string{"account", "destination", "job_id", "final"},
+	exporterDatasetAvailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cloudflare_exporter_dataset_available",
+		Help: "Whether a selected zone or account can be queried for a dataset, 1 if available, 0 if its plan or add-ons don't include it",
+	}, []string{"dataset", "zone", "account", tenantLabel},
 	)
 
-	logpushFailedJobsZone = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: logpushFailedJobsZoneMetricName.String(),
-		Help: "Number of failed logpush jobs on the zone level",
-	},
-		[]string{"destination", "job_id", "final"},
+	exporterLastSuccessWindow = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cloudflare_exporter_last_success_window_timestamp_seconds",
+		Help: "End of the last time window successfully fetched per dataset and zone",
+	}, []string{"dataset", "zone", "account", tenantLabel},
 	)
 )
 
 func buildAllMetricsSet() MetricsSet {
 	allMetricsSet := MetricsSet{}
-	allMetricsSet.Add(zoneRequestTotalMetricName)
-	allMetricsSet.Add(zoneRequestCachedMetricName)
-	allMetricsSet.Add(zoneRequestSSLEncryptedMetricName)
-	allMetricsSet.Add(zoneRequestContentTypeMetricName)
-	allMetricsSet.Add(zoneRequestCountryMetricName)
-	allMetricsSet.Add(zoneRequestHTTPStatusMetricName)
-	allMetricsSet.Add(zoneRequestBrowserMapMetricName)
-	allMetricsSet.Add(zoneRequestOriginStatusCountryHostMetricName)
-	allMetricsSet.Add(zoneRequestStatusCountryHostMetricName)
-	allMetricsSet.Add(zoneBandwidthTotalMetricName)
-	allMetricsSet.Add(zoneBandwidthCachedMetricName)
-	allMetricsSet.Add(zoneBandwidthSSLEncryptedMetricName)
-	allMetricsSet.Add(zoneBandwidthContentTypeMetricName)
-	allMetricsSet.Add(zoneBandwidthCountryMetricName)
-	allMetricsSet.Add(zoneThreatsTotalMetricName)
-	allMetricsSet.Add(zoneThreatsCountryMetricName)
-	allMetricsSet.Add(zoneThreatsTypeMetricName)
-	allMetricsSet.Add(zonePageviewsTotalMetricName)
-	allMetricsSet.Add(zoneUniquesTotalMetricName)
-	allMetricsSet.Add(zoneColocationVisitsMetricName)
-	allMetricsSet.Add(zoneColocationEdgeResponseBytesMetricName)
-	allMetricsSet.Add(zoneColocationRequestsTotalMetricName)
-	allMetricsSet.Add(zoneFirewallEventsCountMetricName)
-	allMetricsSet.Add(zoneHealthCheckEventsOriginCountMetricName)
-	allMetricsSet.Add(workerRequestsMetricName)
-	allMetricsSet.Add(workerErrorsMetricName)
-	allMetricsSet.Add(workerCPUTimeMetricName)
-	allMetricsSet.Add(workerDurationMetricName)
-	allMetricsSet.Add(poolHealthStatusMetricName)
-	allMetricsSet.Add(poolRequestsTotalMetricName)
-	allMetricsSet.Add(logpushFailedJobsAccountMetricName)
-	allMetricsSet.Add(logpushFailedJobsZoneMetricName)
+	for _, def := range metricDefs {
+		allMetricsSet.Add(def.name)
+	}
 	return allMetricsSet
 }
 
-func buildDeniedMetricsSet(metricsDenylist []string) (MetricsSet, error) {
+// buildDeniedMetricsSet returns the metrics of metricsDenylist and, when
+// metricsAllowlist isn't empty, every metric missing from it.
+func buildDeniedMetricsSet(metricsDenylist []string, metricsAllowlist []string) (MetricsSet, error) {
 	deniedMetricsSet := MetricsSet{}
 	allMetricsSet := buildAllMetricsSet()
-	for _, metric := range metricsDenylist {
+	for _, metric := range append(append([]string{}, metricsDenylist...), metricsAllowlist...) {
 		if !allMetricsSet.Has(MetricName(metric)) {
 			return nil, fmt.Errorf("metric %s doesn't exists", metric)
 		}
+	}
+	for _, metric := range metricsDenylist {
 		deniedMetricsSet.Add(MetricName(metric))
 	}
+	if len(metricsAllowlist) > 0 {
+		for _, def := range metricDefs {
+			if !contains(metricsAllowlist, def.name.String()) {
+				deniedMetricsSet.Add(def.name)
+			}
+		}
+	}
 	return deniedMetricsSet, nil
 }
 
-func mustRegisterMetrics(deniedMetrics MetricsSet) {
-	if !deniedMetrics.Has(zoneRequestTotalMetricName) {
-		prometheus.MustRegister(zoneRequestTotal)
-	}
-	if !deniedMetrics.Has(zoneRequestCachedMetricName) {
-		prometheus.MustRegister(zoneRequestCached)
-	}
-	if !deniedMetrics.Has(zoneRequestSSLEncryptedMetricName) {
-		prometheus.MustRegister(zoneRequestSSLEncrypted)
-	}
-	if !deniedMetrics.Has(zoneRequestContentTypeMetricName) {
-		prometheus.MustRegister(zoneRequestContentType)
-	}
-	if !deniedMetrics.Has(zoneRequestCountryMetricName) {
-		prometheus.MustRegister(zoneRequestCountry)
-	}
-	if !deniedMetrics.Has(zoneRequestHTTPStatusMetricName) {
-		prometheus.MustRegister(zoneRequestHTTPStatus)
-	}
-	if !deniedMetrics.Has(zoneRequestBrowserMapMetricName) {
-		prometheus.MustRegister(zoneRequestBrowserMap)
-	}
-	if !deniedMetrics.Has(zoneRequestOriginStatusCountryHostMetricName) {
-		prometheus.MustRegister(zoneRequestOriginStatusCountryHost)
+// buildSeriesTTL parses metric=windows pairs into the number of windows a
+// series of the metric is kept without being updated.
+func buildSeriesTTL(seriesTTL []string) (map[MetricName]int, error) {
+	ttl := map[MetricName]int{}
+	allMetricsSet := buildAllMetricsSet()
+	for _, entry := range seriesTTL {
+		metric, windows, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("series TTL %s must be in metric=windows format", entry)
+		}
+		if !allMetricsSet.Has(MetricName(metric)) {
+			return nil, fmt.Errorf("metric %s doesn't exists", metric)
+		}
+		n, err := strconv.Atoi(windows)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("series TTL of metric %s must be a positive number of windows", metric)
+		}
+		ttl[MetricName(metric)] = n
 	}
-	if !deniedMetrics.Has(zoneRequestStatusCountryHostMetricName) {
-		prometheus.MustRegister(zoneRequestStatusCountryHost)
+	return ttl, nil
+}
+
+// buildDroppedLabels parses metric=label|label pairs into the labels left out
+// of each metric. Only counters can drop labels, their values are summed.
+func buildDroppedLabels(entries []string) (map[MetricName][]string, error) {
+	dropped := map[MetricName][]string{}
+	for _, entry := range entries {
+		metric, labels, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("dropped labels %s must be in metric=label|label format", entry)
+		}
+		def, ok := findMetricDef(MetricName(metric))
+		if !ok {
+			return nil, fmt.Errorf("metric %s doesn't exists", metric)
+		}
+		if def.valueType != prometheus.CounterValue {
+			return nil, fmt.Errorf("metric %s is a gauge, only labels of counters can be dropped", metric)
+		}
+		for _, label := range strings.Split(labels, "|") {
+			if !contains(def.labels, label) {
+				return nil, fmt.Errorf("metric %s has no label %s", metric, label)
+			}
+			dropped[def.name] = append(dropped[def.name], label)
+		}
 	}
-	if !deniedMetrics.Has(zoneBandwidthTotalMetricName) {
-		prometheus.MustRegister(zoneBandwidthTotal)
+	return dropped, nil
+}
+
+// buildTopN parses metric=label:n|label:n pairs into the number of values
+// kept per ranked label of each metric. Only labels of counters, other than
+// zone and account, can be ranked, and only if they aren't dropped.
+func buildTopN(entries []string, dropped map[MetricName][]string) (map[MetricName]map[string]int, error) {
+	ranked := map[MetricName]map[string]int{}
+	for _, entry := range entries {
+		metric, labels, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("top n %s must be in metric=label:n|label:n format", entry)
+		}
+		def, ok := findMetricDef(MetricName(metric))
+		if !ok {
+			return nil, fmt.Errorf("metric %s doesn't exists", metric)
+		}
+		if def.valueType != prometheus.CounterValue {
+			return nil, fmt.Errorf("metric %s is a gauge, only labels of counters can be ranked", metric)
+		}
+		ranked[def.name] = map[string]int{}
+		for _, pair := range strings.Split(labels, "|") {
+			label, count, found := strings.Cut(pair, ":")
+			n, err := strconv.Atoi(count)
+			if !found || err != nil || n < 1 {
+				return nil, fmt.Errorf("top n of metric %s must be in label:n format with a positive n", metric)
+			}
+			if label == "zone" || label == "account" || !contains(def.labels, label) || contains(dropped[def.name], label) {
+				return nil, fmt.Errorf("label %s of metric %s can't be ranked", label, metric)
+			}
+			ranked[def.name][label] = n
+		}
 	}
-	if !deniedMetrics.Has(zoneBandwidthCachedMetricName) {
-		prometheus.MustRegister(zoneBandwidthCached)
+	return ranked, nil
+}
+
+func findMetricDef(name MetricName) (metricDef, bool) {
+	for _, def := range metricDefs {
+		if def.name == name {
+			return def, true
+		}
 	}
-	if !deniedMetrics.Has(zoneBandwidthSSLEncryptedMetricName) {
-		prometheus.MustRegister(zoneBandwidthSSLEncrypted)
+	return metricDef{}, false
+}
+
+// mustRegisterMetrics registers the exporter's own metrics and the metrics
+// not denied, and returns the exporter publishing collected batches in the
+// given mode.
+func mustRegisterMetrics(deniedMetrics MetricsSet, mode string, seriesTTL map[MetricName]int, staticLabels prometheus.Labels) metricsExporter {
+	// Exporter health can't be denied
+	prometheus.MustRegister(exporterUp)
+	prometheus.MustRegister(exporterScrapeErrors)
+	prometheus.MustRegister(exporterAPIRequestDuration)
+	prometheus.MustRegister(exporterAPIResponseSize)
+	prometheus.MustRegister(exporterGraphQLRows)
+	prometheus.MustRegister(exporterCollectionDuration)
+	prometheus.MustRegister(exporterSkippedCycles)
+	prometheus.MustRegister(exporterSeriesExpired)
+	prometheus.MustRegister(exporterBackfilledWindows)
+	prometheus.MustRegister(exporterAPIRetries)
+	prometheus.MustRegister(exporterGraphQLTruncated)
+	prometheus.MustRegister(cfInventories)
+	prometheus.MustRegister(exporterAPIThrottleWait)
+	prometheus.MustRegister(exporterLastSuccessWindow)
+	prometheus.MustRegister(exporterSelectedZones)
+	prometheus.MustRegister(exporterDatasetAvailable)
+
+	prometheus.MustRegister(exporterConfigReloads)
+
+	// Static labels and relabel configs only apply to Cloudflare metrics
+	registerer := prometheus.WrapRegistererWith(staticLabels, cloudflareRegistry)
+
+	if mode == metricsModeWindow {
+		c := newWindowCollector(deniedMetrics)
+		registerer.MustRegister(c)
+		return c
+	}
+
+	vecs := newMetricVecs(deniedMetrics, false)
+	for _, def := range metricDefs {
+		if vec, ok := vecs[def.name]; ok {
+			registerer.MustRegister(vec)
+		}
 	}
-	if !deniedMetrics.Has(zoneBandwidthContentTypeMetricName) {
-		prometheus.MustRegister(zoneBandwidthContentType)
+	return newCounterExporter(vecs, seriesTTL)
+}
+
+func recordScrapeError(ctx context.Context, dataset string, zone string, account string) {
+	exporterScrapeErrors.With(prometheus.Labels{"dataset": dataset, "zone": zone, "account": account, tenantLabel: tenantFromContext(ctx).Name}).Inc()
+}
+
+func recordZonesScrapeError(ctx context.Context, dataset string, zones []cloudflare.Zone) {
+	for _, z := range zones {
+		recordScrapeError(ctx, dataset, z.Name, strings.ToLower(strings.ReplaceAll(z.Account.Name, " ", "-")))
 	}
-	if !deniedMetrics.Has(zoneBandwidthCountryMetricName) {
-		prometheus.MustRegister(zoneBandwidthCountry)
+}
+
+func recordSuccessWindow(ctx context.Context, dataset string, zone string, account string, w timeWindow) {
+	exporterLastSuccessWindow.With(prometheus.Labels{"dataset": dataset, "zone": zone, "account": account, tenantLabel: tenantFromContext(ctx).Name}).Set(float64(w.maxtime.Unix()))
+}
+
+func recordZonesSuccessWindow(ctx context.Context, dataset string, zones []cloudflare.Zone, w timeWindow) {
+	for _, z := range zones {
+		recordSuccessWindow(ctx, dataset, z.Name, strings.ToLower(strings.ReplaceAll(z.Account.Name, " ", "-")), w)
 	}
-	if !deniedMetrics.Has(zoneThreatsTotalMetricName) {
-		prometheus.MustRegister(zoneThreatsTotal)
+}
+
+// gaugeSeries is a series of a gauge vec and its value.
+type gaugeSeries struct {
+	labels prometheus.Labels
+	value  float64
+}
+
+// replacedGauges is a gauge vec whose series are replaced every cycle. Series
+// of the previous cycle missing from the new one are deleted after the new
+// ones are set, so a scrape in between never sees the vec empty.
+type replacedGauges struct {
+	vec  *prometheus.GaugeVec
+	last map[string]prometheus.Labels
+}
+
+func (g *replacedGauges) replace(series []gaugeSeries) {
+	current := make(map[string]prometheus.Labels, len(series))
+	for _, s := range series {
+		g.vec.With(s.labels).Set(s.value)
+		current[seriesKey(s.labels)] = s.labels
 	}
-	if !deniedMetrics.Has(zoneThreatsCountryMetricName) {
-		prometheus.MustRegister(zoneThreatsCountry)
+	for key, labels := range g.last {
+		if _, ok := current[key]; !ok {
+			g.vec.Delete(labels)
+		}
 	}
-	if !deniedMetrics.Has(zoneThreatsTypeMetricName) {
-		prometheus.MustRegister(zoneThreatsType)
+	g.last = current
+}
+
+var selectedZones = &replacedGauges{vec: exporterSelectedZones}
+
+// recordSelectedZones replaces the selected zones of the previous cycle.
+func recordSelectedZones(scopes []tenantScope) {
+	var series []gaugeSeries
+	for _, scope := range scopes {
+		for _, z := range scope.zones {
+			series = append(series, gaugeSeries{labels: prometheus.Labels{
+				"zone":      z.Name,
+				"zone_id":   z.ID,
+				"account":   strings.ToLower(strings.ReplaceAll(z.Account.Name, " ", "-")),
+				"plan":      z.Plan.LegacyID,
+				"status":    z.Status,
+				"paused":    strconv.FormatBool(z.Paused),
+				tenantLabel: scope.tenant.Name,
+			}, value: 1})
+		}
 	}
-	if !deniedMetrics.Has(zonePageviewsTotalMetricName) {
-		prometheus.MustRegister(zonePageviewsTotal)
+	selectedZones.replace(series)
+}
+
+var datasetAvailability = &replacedGauges{vec: exporterDatasetAvailable}
+
+// recordDatasetAvailability replaces the dataset availability of the
+// previous cycle.
+func recordDatasetAvailability(scopes []tenantScope) {
+	var series []gaugeSeries
+	for _, scope := range scopes {
+		for _, z := range scope.zones {
+			account := strings.ToLower(strings.ReplaceAll(z.Account.Name, " ", "-"))
+			for _, dataset := range zoneDatasets() {
+				series = append(series, gaugeSeries{
+					labels: prometheus.Labels{"dataset": dataset, "zone": z.Name, "account": account, tenantLabel: scope.tenant.Name},
+					value:  boolToFloat(scope.caps.available(z.ID, dataset)),
+				})
+			}
+		}
+		for _, a := range scope.accounts {
+			account := strings.ToLower(strings.ReplaceAll(a.Name, " ", "-"))
+			for _, dataset := range accountDatasets() {
+				series = append(series, gaugeSeries{
+					labels: prometheus.Labels{"dataset": dataset, "zone": "", "account": account, tenantLabel: scope.tenant.Name},
+					value:  boolToFloat(scope.caps.available(a.ID, dataset)),
+				})
+			}
+		}
 	}
-	if !deniedMetrics.Has(zoneUniquesTotalMetricName) {
-		prometheus.MustRegister(zoneUniquesTotal)
+	datasetAvailability.replace(series)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
 	}
-	if !deniedMetrics.Has(zoneColocationVisitsMetricName) {
-		prometheus.MustRegister(zoneColocationVisits)
+	return 0
+}
+
+func recordTruncated(ctx context.Context, dataset string, zone string, account string) {
+	scope := account
+	if zone != "" {
+		scope = zone
 	}
-	if !deniedMetrics.Has(zoneColocationEdgeResponseBytesMetricName) {
-		prometheus.MustRegister(zoneColocationEdgeResponseBytes)
+	log.Warn(dataset, " result of ", scope, " still truncated at ", graphqlLimit, " rows after splitting, metrics undercount")
+	exporterGraphQLTruncated.With(prometheus.Labels{"dataset": dataset, "zone": zone, "account": account, tenantLabel: tenantFromContext(ctx).Name}).Inc()
+}
+
+func recordZonesTruncated(ctx context.Context, dataset string, zones []cloudflare.Zone, tags []string) {
+	for _, tag := range tags {
+		name, account := findZoneAccountName(zones, tag)
+		recordTruncated(ctx, dataset, name, account)
 	}
-	if !deniedMetrics.Has(zoneColocationRequestsTotalMetricName) {
-		prometheus.MustRegister(zoneColocationRequestsTotal)
+}
+
+func recordGraphQLRows(dataset string, rows int) {
+	exporterGraphQLRows.With(prometheus.Labels{"dataset": dataset}).Add(float64(rows))
+}
+
+func fetchWorkerAnalytics(ctx context.Context, account cloudflare.Account, w timeWindow, b *metricBatch) error {
+	// Replace spaces with hyphens and convert to lowercase
+	accountName := strings.ToLower(strings.ReplaceAll(account.Name, " ", "-"))
+
+	// Only the scripts from the REST API are exported.
+	if !nodeWanted(datasetWorkers, "workersInvocationsAdaptive") {
+		addWorkerScripts(ctx, b, account, accountName)
+		return nil
 	}
-	if !deniedMetrics.Has(zoneFirewallEventsCountMetricName) {
-		prometheus.MustRegister(zoneFirewallEventsCount)
+
+	r, truncated, err := fetchComplete(ctx, []string{account.ID}, w, func(ctx context.Context, ids []string, w timeWindow) ([]accountResp, error) {
+		return fetchWorkerTotals(ctx, ids[0], w)
+	})
+	if err != nil {
+		recordScrapeError(ctx, datasetWorkers, "", accountName)
+		return err
 	}
-	if !deniedMetrics.Has(zoneHealthCheckEventsOriginCountMetricName) {
-		prometheus.MustRegister(zoneHealthCheckEventsOriginCount)
+	recordSuccessWindow(ctx, datasetWorkers, "", accountName, w)
+	if len(truncated) > 0 {
+		recordTruncated(ctx, datasetWorkers, "", accountName)
 	}
-	if !deniedMetrics.Has(workerRequestsMetricName) {
-		prometheus.MustRegister(workerRequests)
+
+	// A script has one row per status, unless the window was split after
+	// truncation. The quantiles of split rows are averaged weighted by their
+	// requests.
+	quantiles := map[[2]string]*workerQuantiles{}
+	for _, a := range r {
+		recordGraphQLRows("workersInvocationsAdaptive", len(a.WorkersInvocationsAdaptive))
+		for _, w := range a.WorkersInvocationsAdaptive {
+			labels := prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName, "status": w.Dimensions.Status}
+			b.add(workerRequestsMetricName, labels, float64(w.Sum.Requests))
+			b.add(workerErrorsMetricName, labels, float64(w.Sum.Errors))
+
+			key := [2]string{w.Dimensions.ScriptName, w.Dimensions.Status}
+			q, ok := quantiles[key]
+			if !ok {
+				q = &workerQuantiles{}
+				quantiles[key] = q
+			}
+			q.add(w.Sum.Requests,
+				[]float32{w.Quantiles.CPUTimeP50, w.Quantiles.CPUTimeP75, w.Quantiles.CPUTimeP99, w.Quantiles.CPUTimeP999},
+				[]float32{w.Quantiles.DurationP50, w.Quantiles.DurationP75, w.Quantiles.DurationP99, w.Quantiles.DurationP999})
+		}
 	}
-	if !deniedMetrics.Has(workerErrorsMetricName) {
-		prometheus.MustRegister(workerErrors)
+	for key, q := range quantiles {
+		for i, quantile := range workerQuantileNames {
+			labels := prometheus.Labels{"script_name": key[0], "account": accountName, "status": key[1], "quantile": quantile}
+			b.set(workerCPUTimeMetricName, labels, q.cpuTime[i]/q.weight)
+			b.set(workerDurationMetricName, labels, q.duration[i]/q.weight)
+		}
 	}
-	if !deniedMetrics.Has(workerCPUTimeMetricName) {
-		prometheus.MustRegister(workerCPUTime)
+
+	addWorkerScripts(ctx, b, account, accountName)
+	return nil
+}
+
+func fetchWorkerSubrequestAnalytics(ctx context.Context, account cloudflare.Account, w timeWindow, b *metricBatch) error {
+	accountName := strings.ToLower(strings.ReplaceAll(account.Name, " ", "-"))
+
+	r, truncated, err := fetchComplete(ctx, []string{account.ID}, w, func(ctx context.Context, ids []string, w timeWindow) ([]accountResp, error) {
+		return fetchWorkerSubrequests(ctx, ids[0], w)
+	})
+	if err != nil {
+		recordScrapeError(ctx, datasetSubrequests, "", accountName)
+		return err
 	}
-	if !deniedMetrics.Has(workerDurationMetricName) {
-		prometheus.MustRegister(workerDuration)
+	recordSuccessWindow(ctx, datasetSubrequests, "", accountName, w)
+	if len(truncated) > 0 {
+		recordTruncated(ctx, datasetSubrequests, "", accountName)
 	}
-	if !deniedMetrics.Has(poolHealthStatusMetricName) {
-		prometheus.MustRegister(poolHealthStatus)
+
+	for _, a := range r {
+		recordGraphQLRows("workersSubrequestsAdaptiveGroups", len(a.WorkersSubrequestsAdaptiveGroups))
+		for _, g := range a.WorkersSubrequestsAdaptiveGroups {
+			b.add(workerSubrequestsMetricName,
+				prometheus.Labels{
+					"script_name":  g.Dimensions.ScriptName,
+					"account":      accountName,
+					"host":         g.Dimensions.Hostname,
+					"cache_status": g.Dimensions.CacheStatus,
+					"status":       strconv.Itoa(int(g.Dimensions.HTTPResponseStatus)),
+				}, float64(g.Sum.Subrequests))
+		}
 	}
-	if !deniedMetrics.Has(poolRequestsTotalMetricName) {
-		prometheus.MustRegister(poolRequestsTotal)
+	return nil
+}
+
+func fetchWorkerScheduledAnalytics(ctx context.Context, account cloudflare.Account, w timeWindow, b *metricBatch) error {
+	accountName := strings.ToLower(strings.ReplaceAll(account.Name, " ", "-"))
+
+	r, truncated, err := fetchComplete(ctx, []string{account.ID}, w, func(ctx context.Context, ids []string, w timeWindow) ([]accountResp, error) {
+		return fetchWorkerScheduled(ctx, ids[0], w)
+	})
+	if err != nil {
+		recordScrapeError(ctx, datasetScheduled, "", accountName)
+		return err
 	}
-	if !deniedMetrics.Has(logpushFailedJobsAccountMetricName) {
-		prometheus.MustRegister(logpushFailedJobsAccount)
+	recordSuccessWindow(ctx, datasetScheduled, "", accountName, w)
+	if len(truncated) > 0 {
+		recordTruncated(ctx, datasetScheduled, "", accountName)
 	}
-	if !deniedMetrics.Has(logpushFailedJobsZoneMetricName) {
-		prometheus.MustRegister(logpushFailedJobsZone)
+
+	for _, a := range r {
+		recordGraphQLRows("workersInvocationsScheduled", len(a.WorkersInvocationsScheduled))
+		for _, inv := range a.WorkersInvocationsScheduled {
+			labels := prometheus.Labels{"script_name": inv.ScriptName, "account": accountName, "cron": inv.Cron, "status": inv.Status}
+			b.add(workerScheduledInvocationsMetricName, labels, 1)
+			b.add(workerScheduledCPUTimeMetricName, labels, inv.CPUTimeUs/1e6)
+		}
 	}
+	return nil
 }
 
-func fetchWorkerAnalytics(account cloudflare.Account, wg *sync.WaitGroup) {
-	wg.Add(1)
-	defer wg.Done()
+func fetchQueueAnalytics(ctx context.Context, account cloudflare.Account, w timeWindow, b *metricBatch) error {
+	accountName := strings.ToLower(strings.ReplaceAll(account.Name, " ", "-"))
 
-	r, err := fetchWorkerTotals(account.ID)
+	r, truncated, err := fetchComplete(ctx, []string{account.ID}, w, func(ctx context.Context, ids []string, w timeWindow) ([]accountResp, error) {
+		return fetchQueues(ctx, ids[0], w)
+	})
 	if err != nil {
-		return
+		recordScrapeError(ctx, datasetQueues, "", accountName)
+		return err
+	}
+	recordSuccessWindow(ctx, datasetQueues, "", accountName, w)
+	if len(truncated) > 0 {
+		recordTruncated(ctx, datasetQueues, "", accountName)
+	}
+
+	// A queue has one row per window, unless the window was split after
+	// truncation. The averages of split rows are combined weighted by their
+	// samples.
+	avgs := &weightedGauges{}
+	for _, a := range r {
+		recordGraphQLRows("queueConsumerMetricsAdaptiveGroups", len(a.QueueConsumerMetricsAdaptiveGroups))
+		recordGraphQLRows("queueBacklogAdaptiveGroups", len(a.QueueBacklogAdaptiveGroups))
+		for _, g := range a.QueueConsumerMetricsAdaptiveGroups {
+			avgs.add(queueConsumerConcurrencyMetricName, prometheus.Labels{"script_name": g.Dimensions.ScriptName, "account": accountName, "queue_id": g.Dimensions.QueueID}, g.Avg.Concurrency, g.Count)
+		}
+		for _, g := range a.QueueBacklogAdaptiveGroups {
+			avgs.add(queueBacklogMessagesMetricName, prometheus.Labels{"account": accountName, "queue_id": g.Dimensions.QueueID}, g.Avg.Messages, g.Count)
+			avgs.add(queueBacklogBytesMetricName, prometheus.Labels{"account": accountName, "queue_id": g.Dimensions.QueueID}, g.Avg.Bytes, g.Count)
+		}
 	}
+	avgs.set(b)
+	return nil
+}
 
-	// Replace spaces with hyphens and convert to lowercase
-	accountName := strings.ToLower(strings.ReplaceAll(account.Name, " ", "-"))
+var workerQuantileNames = []string{"P50", "P75", "P99", "P999"}
 
-	for _, a := range r.Viewer.Accounts {
-		for _, w := range a.WorkersInvocationsAdaptive {
-			workerRequests.With(prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName}).Add(float64(w.Sum.Requests))
-			workerErrors.With(prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName}).Add(float64(w.Sum.Errors))
-			workerCPUTime.With(prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName, "quantile": "P50"}).Set(float64(w.Quantiles.CPUTimeP50))
-			workerCPUTime.With(prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName, "quantile": "P75"}).Set(float64(w.Quantiles.CPUTimeP75))
-			workerCPUTime.With(prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName, "quantile": "P99"}).Set(float64(w.Quantiles.CPUTimeP99))
-			workerCPUTime.With(prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName, "quantile": "P999"}).Set(float64(w.Quantiles.CPUTimeP999))
-			workerDuration.With(prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName, "quantile": "P50"}).Set(float64(w.Quantiles.DurationP50))
-			workerDuration.With(prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName, "quantile": "P75"}).Set(float64(w.Quantiles.DurationP75))
-			workerDuration.With(prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName, "quantile": "P99"}).Set(float64(w.Quantiles.DurationP99))
-			workerDuration.With(prometheus.Labels{"script_name": w.Dimensions.ScriptName, "account": accountName, "quantile": "P999"}).Set(float64(w.Quantiles.DurationP999))
-		}
+// workerQuantiles sums the quantiles of a script's rows weighted by their
+// requests.
+type workerQuantiles struct {
+	weight   float64
+	cpuTime  [4]float64
+	duration [4]float64
+}
+
+func (q *workerQuantiles) add(requests uint64, cpuTime []float32, duration []float32) {
+	// Rows without requests still count, so the weight is never zero.
+	weight := float64(max(requests, 1))
+	q.weight += weight
+	for i := range workerQuantileNames {
+		q.cpuTime[i] += float64(cpuTime[i]) * weight
+		q.duration[i] += float64(duration[i]) * weight
 	}
 }
 
-func fetchLogpushAnalyticsForAccount(account cloudflare.Account, wg *sync.WaitGroup) {
-	wg.Add(1)
-	defer wg.Done()
+// weightedGauges averages the values a gauge series takes in the rows of a
+// window split after truncation, weighted by the samples of each row.
+type weightedGauges struct {
+	series []*weightedGauge
+	index  map[string]*weightedGauge
+}
 
-	if viper.GetBool("free_tier") {
+type weightedGauge struct {
+	name   MetricName
+	labels prometheus.Labels
+	sum    float64
+	weight float64
+}
+
+func (g *weightedGauges) add(name MetricName, labels prometheus.Labels, value float64, samples uint64) {
+	if g.index == nil {
+		g.index = map[string]*weightedGauge{}
+	}
+	key := name.String() + "\xff" + seriesKey(labels)
+	s, ok := g.index[key]
+	if !ok {
+		s = &weightedGauge{name: name, labels: labels}
+		g.index[key] = s
+		g.series = append(g.series, s)
+	}
+	// Rows without samples still count, so the weight is never zero.
+	weight := float64(max(samples, 1))
+	s.sum += value * weight
+	s.weight += weight
+}
+
+// set sets the averaged gauges in b.
+func (g *weightedGauges) set(b *metricBatch) {
+	for _, s := range g.series {
+		b.set(s.name, s.labels, s.sum/s.weight)
+	}
+}
+
+// addWorkerScripts exports the worker scripts of the account from the REST
+// API, refreshed every inventory_ttl. A failed lookup is only counted as a
+// scrape error, the window's GraphQL data is kept.
+func addWorkerScripts(ctx context.Context, b *metricBatch, account cloudflare.Account, accountName string) {
+	if deniedMetrics.Has(workerScriptInfoMetricName) {
 		return
 	}
+	scripts, err := inventoryFor(ctx).workerScripts(ctx, account.ID)
+	if err != nil {
+		log.Error("failed to fetch worker scripts for account ", accountName, ": ", err)
+		recordScrapeError(ctx, datasetWorkerScripts, "", accountName)
+	}
+	for _, s := range scripts {
+		b.set(workerScriptInfoMetricName,
+			prometheus.Labels{
+				"script_name":   s.ID,
+				"account":       accountName,
+				"deployment_id": derefString(s.DeploymentId),
+				"etag":          s.ETAG,
+				"deployed_from": derefString(s.LastDeployedFrom),
+			}, 1)
+	}
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
 
-	r, err := fetchLogpushAccount(account.ID)
+func fetchLogpushAnalyticsForAccount(ctx context.Context, account cloudflare.Account, w timeWindow, b *metricBatch) error {
+	accountName := strings.ToLower(strings.ReplaceAll(account.Name, " ", "-"))
 
+	r, truncated, err := fetchComplete(ctx, []string{account.ID}, w, func(ctx context.Context, ids []string, w timeWindow) ([]logpushResponse, error) {
+		return fetchLogpushAccount(ctx, ids[0], w)
+	})
 	if err != nil {
-		return
+		recordScrapeError(ctx, datasetLogpushAccount, "", accountName)
+		return err
+	}
+	recordSuccessWindow(ctx, datasetLogpushAccount, "", accountName, w)
+	if len(truncated) > 0 {
+		recordTruncated(ctx, datasetLogpushAccount, "", accountName)
 	}
 
-	for _, acc := range r.Viewer.Accounts {
+	for _, acc := range r {
+		recordGraphQLRows("logpushHealthAdaptiveGroups", len(acc.LogpushHealthAdaptiveGroups))
 		for _, LogpushHealthAdaptiveGroup := range acc.LogpushHealthAdaptiveGroups {
-			logpushFailedJobsAccount.With(prometheus.Labels{"account": account.ID,
+			b.add(logpushFailedJobsAccountMetricName, prometheus.Labels{"account": account.ID,
 				"destination": LogpushHealthAdaptiveGroup.Dimensions.DestinationType,
 				"job_id":      strconv.Itoa(LogpushHealthAdaptiveGroup.Dimensions.JobID),
-				"final":       strconv.Itoa(LogpushHealthAdaptiveGroup.Dimensions.Final)}).Add(float64(LogpushHealthAdaptiveGroup.Count))
+				"final":       strconv.Itoa(LogpushHealthAdaptiveGroup.Dimensions.Final)}, float64(LogpushHealthAdaptiveGroup.Count))
 		}
 	}
+	return nil
 }
 
-func fetchLogpushAnalyticsForZone(zones []cloudflare.Zone, wg *sync.WaitGroup) {
-	wg.Add(1)
-	defer wg.Done()
-
-	if viper.GetBool("free_tier") {
-		return
-	}
-
-	zoneIDs := extractZoneIDs(filterNonFreePlanZones(zones))
+func fetchLogpushAnalyticsForZone(ctx context.Context, zones []cloudflare.Zone, w timeWindow, b *metricBatch) error {
+	zoneIDs := extractZoneIDs(zones)
 	if len(zoneIDs) == 0 {
-		return
+		return nil
 	}
 
-	r, err := fetchLogpushZone(zoneIDs)
-
+	r, truncated, err := fetchComplete(ctx, zoneIDs, w, fetchLogpushZone)
 	if err != nil {
-		return
+		recordZonesScrapeError(ctx, datasetLogpushZone, zones)
+		return err
 	}
+	recordZonesSuccessWindow(ctx, datasetLogpushZone, zones, w)
+	recordZonesTruncated(ctx, datasetLogpushZone, zones, truncated)
 
-	for _, zone := range r.Viewer.Zones {
+	for _, zone := range r {
+		recordGraphQLRows("logpushHealthAdaptiveGroups", len(zone.LogpushHealthAdaptiveGroups))
 		for _, LogpushHealthAdaptiveGroup := range zone.LogpushHealthAdaptiveGroups {
-			logpushFailedJobsZone.With(prometheus.Labels{"destination": LogpushHealthAdaptiveGroup.Dimensions.DestinationType,
+			b.add(logpushFailedJobsZoneMetricName, prometheus.Labels{"destination": LogpushHealthAdaptiveGroup.Dimensions.DestinationType,
 				"job_id": strconv.Itoa(LogpushHealthAdaptiveGroup.Dimensions.JobID),
-				"final":  strconv.Itoa(LogpushHealthAdaptiveGroup.Dimensions.Final)}).Add(float64(LogpushHealthAdaptiveGroup.Count))
+				"final":  strconv.Itoa(LogpushHealthAdaptiveGroup.Dimensions.Final)}, float64(LogpushHealthAdaptiveGroup.Count))
 		}
 	}
+	return nil
 }
 
-func fetchZoneColocationAnalytics(zones []cloudflare.Zone, wg *sync.WaitGroup) {
-	wg.Add(1)
-	defer wg.Done()
-
-	// Colocation metrics are not available in non-enterprise zones
-	if viper.GetBool("free_tier") {
-		return
-	}
-
-	zoneIDs := extractZoneIDs(filterNonFreePlanZones(zones))
+func fetchZoneColocationAnalytics(ctx context.Context, zones []cloudflare.Zone, w timeWindow, b *metricBatch) error {
+	zoneIDs := extractZoneIDs(zones)
 	if len(zoneIDs) == 0 {
-		return
+		return nil
 	}
 
-	r, err := fetchColoTotals(zoneIDs)
+	r, truncated, err := fetchComplete(ctx, zoneIDs, w, fetchColoTotals)
 	if err != nil {
-		return
+		recordZonesScrapeError(ctx, datasetColocation, zones)
+		return err
 	}
-	for _, z := range r.Viewer.Zones {
+	recordZonesSuccessWindow(ctx, datasetColocation, zones, w)
+	recordZonesTruncated(ctx, datasetColocation, zones, truncated)
+
+	for _, z := range r {
 		cg := z.ColoGroups
+		recordGraphQLRows("httpRequestsAdaptiveGroups", len(cg))
 		name, account := findZoneAccountName(zones, z.ZoneTag)
 		for _, c := range cg {
-			zoneColocationVisits.With(prometheus.Labels{"zone": name, "account": account, "colocation": c.Dimensions.ColoCode, "host": c.Dimensions.Host}).Add(float64(c.Sum.Visits))
-			zoneColocationEdgeResponseBytes.With(prometheus.Labels{"zone": name, "account": account, "colocation": c.Dimensions.ColoCode, "host": c.Dimensions.Host}).Add(float64(c.Sum.EdgeResponseBytes))
-			zoneColocationRequestsTotal.With(prometheus.Labels{"zone": name, "account": account, "colocation": c.Dimensions.ColoCode, "host": c.Dimensions.Host}).Add(float64(c.Count))
+			b.add(zoneColocationVisitsMetricName, prometheus.Labels{"zone": name, "account": account, "colocation": c.Dimensions.ColoCode, "host": c.Dimensions.Host}, float64(c.Sum.Visits))
+			b.add(zoneColocationEdgeResponseBytesMetricName, prometheus.Labels{"zone": name, "account": account, "colocation": c.Dimensions.ColoCode, "host": c.Dimensions.Host}, float64(c.Sum.EdgeResponseBytes))
+			b.add(zoneColocationRequestsTotalMetricName, prometheus.Labels{"zone": name, "account": account, "colocation": c.Dimensions.ColoCode, "host": c.Dimensions.Host}, float64(c.Count))
 		}
 	}
+	return nil
 }
 
-func fetchZoneAnalytics(zones []cloudflare.Zone, wg *sync.WaitGroup) {
-	wg.Add(1)
-	defer wg.Done()
-
-	// None of the below referenced metrics are available in the free tier
-	if viper.GetBool("free_tier") {
-		return
+func fetchZoneAnalytics(ctx context.Context, zones []cloudflare.Zone, w timeWindow, b *metricBatch) error {
+	zoneIDs := extractZoneIDs(zones)
+	if len(zoneIDs) == 0 {
+		return nil
 	}
 
-	zoneIDs := extractZoneIDs(filterNonFreePlanZones(zones))
-	if len(zoneIDs) == 0 {
-		return
+	// Only the health checks from the REST API are exported.
+	if !anyNodeWanted(datasetZoneTotals, zoneTotalsNodes...) {
+		for _, zone := range zones {
+			name, account := findZoneAccountName(zones, zone.ID)
+			addHealthChecks(ctx, b, zone.ID, name, account)
+		}
+		return nil
 	}
 
-	r, err := fetchZoneTotals(zoneIDs)
+	r, truncated, err := fetchComplete(ctx, zoneIDs, w, fetchZoneTotals)
 	if err != nil {
-		return
+		recordZonesScrapeError(ctx, datasetZoneTotals, zones)
+		return err
 	}
+	recordZonesSuccessWindow(ctx, datasetZoneTotals, zones, w)
+	recordZonesTruncated(ctx, datasetZoneTotals, zones, truncated)
 
-	for _, z := range r.Viewer.Zones {
+	// Health check RTT quantiles of split windows are averaged weighted by
+	// their checks.
+	rtt := &weightedGauges{}
+	for _, z := range r {
 		name, account := findZoneAccountName(zones, z.ZoneTag)
 		z := z
 
-		addHTTPGroups(&z, name, account)
-		addFirewallGroups(&z, name, account)
-		addHealthCheckGroups(&z, name, account)
-		addHTTPAdaptiveGroups(&z, name, account)
-	}
+		recordGraphQLRows("httpRequests1mGroups", len(z.HTTP1mGroups))
+		recordGraphQLRows("firewallEventsAdaptiveGroups", len(z.FirewallEventsAdaptiveGroups))
+		recordGraphQLRows("httpRequestsAdaptiveGroups", len(z.HTTPRequestsAdaptiveGroups))
+		recordGraphQLRows("httpRequestsEdgeCountryHost", len(z.HTTPRequestsEdgeCountryHost))
+		recordGraphQLRows("healthCheckEventsAdaptiveGroups", len(z.HealthCheckEventsAdaptiveGroups))
+		recordGraphQLRows("healthCheckFailures", len(z.HealthCheckFailures))
+		recordGraphQLRows("healthCheckEventsRtt", len(z.HealthCheckEventsRtt))
+
+		addHTTPGroups(b, &z, name, account)
+		addFirewallGroups(ctx, b, &z, name, account)
+		addHealthCheckGroups(b, rtt, &z, name, account)
+		addHealthChecks(ctx, b, z.ZoneTag, name, account)
+		addHTTPAdaptiveGroups(b, &z, name, account)
+	}
+	rtt.set(b)
+	return nil
 }
 
-func addHTTPGroups(z *zoneResp, name string, account string) {
-	// Nothing to do.
-	if len(z.HTTP1mGroups) == 0 {
-		return
-	}
+func addHTTPGroups(b *metricBatch, z *zoneResp, name string, account string) {
+	// A window longer than a minute returns a group per minute, they add up
+	// to the window's totals.
+	for _, zt := range z.HTTP1mGroups {
+		b.add(zoneRequestTotalMetricName, prometheus.Labels{"zone": name, "account": account}, float64(zt.Sum.Requests))
+		b.add(zoneRequestCachedMetricName, prometheus.Labels{"zone": name, "account": account}, float64(zt.Sum.CachedRequests))
+		b.add(zoneRequestSSLEncryptedMetricName, prometheus.Labels{"zone": name, "account": account}, float64(zt.Sum.EncryptedRequests))
+
+		for _, ct := range zt.Sum.ContentType {
+			b.add(zoneRequestContentTypeMetricName, prometheus.Labels{"zone": name, "account": account, "content_type": ct.EdgeResponseContentType}, float64(ct.Requests))
+			b.add(zoneBandwidthContentTypeMetricName, prometheus.Labels{"zone": name, "account": account, "content_type": ct.EdgeResponseContentType}, float64(ct.Bytes))
+		}
 
-	zt := z.HTTP1mGroups[0]
+		for _, country := range zt.Sum.Country {
+			c := countries.ByName(country.ClientCountryName)
+			region := c.Info().Region.Info().Name
 
-	zoneRequestTotal.With(prometheus.Labels{"zone": name, "account": account}).Add(float64(zt.Sum.Requests))
-	zoneRequestCached.With(prometheus.Labels{"zone": name, "account": account}).Add(float64(zt.Sum.CachedRequests))
-	zoneRequestSSLEncrypted.With(prometheus.Labels{"zone": name, "account": account}).Add(float64(zt.Sum.EncryptedRequests))
+			b.add(zoneRequestCountryMetricName, prometheus.Labels{"zone": name, "account": account, "country": country.ClientCountryName, "region": region}, float64(country.Requests))
+			b.add(zoneBandwidthCountryMetricName, prometheus.Labels{"zone": name, "account": account, "country": country.ClientCountryName, "region": region}, float64(country.Bytes))
+			b.add(zoneThreatsCountryMetricName, prometheus.Labels{"zone": name, "account": account, "country": country.ClientCountryName, "region": region}, float64(country.Threats))
+		}
 
-	for _, ct := range zt.Sum.ContentType {
-		zoneRequestContentType.With(prometheus.Labels{"zone": name, "account": account, "content_type": ct.EdgeResponseContentType}).Add(float64(ct.Requests))
-		zoneBandwidthContentType.With(prometheus.Labels{"zone": name, "account": account, "content_type": ct.EdgeResponseContentType}).Add(float64(ct.Bytes))
-	}
+		for _, status := range zt.Sum.ResponseStatus {
+			b.add(zoneRequestHTTPStatusMetricName, prometheus.Labels{"zone": name, "account": account, "status": strconv.Itoa(status.EdgeResponseStatus)}, float64(status.Requests))
+		}
 
-	for _, country := range zt.Sum.Country {
-		c := countries.ByName(country.ClientCountryName)
-		region := c.Info().Region.Info().Name
+		for _, browser := range zt.Sum.BrowserMap {
+			b.add(zoneRequestBrowserMapMetricName, prometheus.Labels{"zone": name, "account": account, "family": browser.UaBrowserFamily}, float64(browser.PageViews))
+		}
 
-		zoneRequestCountry.With(prometheus.Labels{"zone": name, "account": account, "country": country.ClientCountryName, "region": region}).Add(float64(country.Requests))
-		zoneBandwidthCountry.With(prometheus.Labels{"zone": name, "account": account, "country": country.ClientCountryName, "region": region}).Add(float64(country.Bytes))
-		zoneThreatsCountry.With(prometheus.Labels{"zone": name, "account": account, "country": country.ClientCountryName, "region": region}).Add(float64(country.Threats))
-	}
+		for _, v := range zt.Sum.ClientHTTPVersion {
+			b.add(zoneRequestHTTPProtocolMetricName, prometheus.Labels{"zone": name, "account": account, "protocol": v.Protocol}, float64(v.Requests))
+		}
 
-	for _, status := range zt.Sum.ResponseStatus {
-		zoneRequestHTTPStatus.With(prometheus.Labels{"zone": name, "account": account, "status": strconv.Itoa(status.EdgeResponseStatus)}).Add(float64(status.Requests))
-	}
+		for _, ssl := range zt.Sum.ClientSSL {
+			b.add(zoneRequestTLSVersionMetricName, prometheus.Labels{"zone": name, "account": account, "tls_version": ssl.Protocol}, float64(ssl.Requests))
+		}
 
-	for _, browser := range zt.Sum.BrowserMap {
-		zoneRequestBrowserMap.With(prometheus.Labels{"zone": name, "account": account, "family": browser.UaBrowserFamily}).Add(float64(browser.PageViews))
-	}
+		for _, c := range zt.Sum.IPClass {
+			b.add(zoneRequestIPClassMetricName, prometheus.Labels{"zone": name, "account": account, "ip_class": c.Type}, float64(c.Requests))
+		}
 
-	zoneBandwidthTotal.With(prometheus.Labels{"zone": name, "account": account}).Add(float64(zt.Sum.Bytes))
-	zoneBandwidthCached.With(prometheus.Labels{"zone": name, "account": account}).Add(float64(zt.Sum.CachedBytes))
-	zoneBandwidthSSLEncrypted.With(prometheus.Labels{"zone": name, "account": account}).Add(float64(zt.Sum.EncryptedBytes))
+		b.add(zoneBandwidthTotalMetricName, prometheus.Labels{"zone": name, "account": account}, float64(zt.Sum.Bytes))
+		b.add(zoneBandwidthCachedMetricName, prometheus.Labels{"zone": name, "account": account}, float64(zt.Sum.CachedBytes))
+		b.add(zoneBandwidthSSLEncryptedMetricName, prometheus.Labels{"zone": name, "account": account}, float64(zt.Sum.EncryptedBytes))
 
-	zoneThreatsTotal.With(prometheus.Labels{"zone": name, "account": account}).Add(float64(zt.Sum.Threats))
+		b.add(zoneThreatsTotalMetricName, prometheus.Labels{"zone": name, "account": account}, float64(zt.Sum.Threats))
 
-	for _, t := range zt.Sum.ThreatPathing {
-		zoneThreatsType.With(prometheus.Labels{"zone": name, "account": account, "type": t.Name}).Add(float64(t.Requests))
-	}
+		for _, t := range zt.Sum.ThreatPathing {
+			b.add(zoneThreatsTypeMetricName, prometheus.Labels{"zone": name, "account": account, "type": t.Name}, float64(t.Requests))
+		}
 
-	zonePageviewsTotal.With(prometheus.Labels{"zone": name, "account": account}).Add(float64(zt.Sum.PageViews))
+		b.add(zonePageviewsTotalMetricName, prometheus.Labels{"zone": name, "account": account}, float64(zt.Sum.PageViews))
 
-	// Uniques
-	zoneUniquesTotal.With(prometheus.Labels{"zone": name, "account": account}).Add(float64(zt.Unique.Uniques))
+		// Uniques
+		b.add(zoneUniquesTotalMetricName, prometheus.Labels{"zone": name, "account": account}, float64(zt.Unique.Uniques))
+	}
 }
 
-func addFirewallGroups(z *zoneResp, name string, account string) {
+// addFirewallGroups exports firewall events of the zone. Events are exported
+// even when rule names can't be fetched, the rule label is empty for them and
+// the failed lookup is only counted as a scrape error, so the window's
+// GraphQL data is kept.
+func addFirewallGroups(ctx context.Context, b *metricBatch, z *zoneResp, name string, account string) {
 	// Nothing to do.
 	if len(z.FirewallEventsAdaptiveGroups) == 0 {
 		return
 	}
-	rulesMap := fetchFirewallRules(z.ZoneTag)
+	// Rule descriptions aren't needed when the rule label is dropped.
+	var rulesMap map[string]string
+	if labelKept(datasetZoneTotals, "firewallEventsAdaptiveGroups", "rule") {
+		var err error
+		rulesMap, err = inventoryFor(ctx).firewallRules(ctx, z.ZoneTag)
+		if err != nil {
+			log.Error("failed to fetch firewall rules for zone ", name, ": ", err)
+			recordScrapeError(ctx, datasetFirewallRules, name, account)
+		}
+	}
 	for _, g := range z.FirewallEventsAdaptiveGroups {
-		zoneFirewallEventsCount.With(
+		b.add(zoneFirewallEventsCountMetricName,
 			prometheus.Labels{
 				"zone":    name,
 				"account": account,
@@ -617,7 +1318,7 @@ func addFirewallGroups(z *zoneResp, name string, account string) {
 				"rule":    normalizeRuleName(rulesMap[g.Dimensions.RuleID]),
 				"host":    g.Dimensions.ClientRequestHTTPHost,
 				"country": g.Dimensions.ClientCountryName,
-			}).Add(float64(g.Count))
+			}, float64(g.Count))
 	}
 }
 
@@ -630,13 +1331,9 @@ func normalizeRuleName(initialText string) string {
 	return nonSpaceName
 }
 
-func addHealthCheckGroups(z *zoneResp, name string, account string) {
-	if len(z.HealthCheckEventsAdaptiveGroups) == 0 {
-		return
-	}
-
+func addHealthCheckGroups(b *metricBatch, rtt *weightedGauges, z *zoneResp, name string, account string) {
 	for _, g := range z.HealthCheckEventsAdaptiveGroups {
-		zoneHealthCheckEventsOriginCount.With(
+		b.add(zoneHealthCheckEventsOriginCountMetricName,
 			prometheus.Labels{
 				"zone":          name,
 				"account":       account,
@@ -644,83 +1341,168 @@ func addHealthCheckGroups(z *zoneResp, name string, account string) {
 				"origin_ip":     g.Dimensions.OriginIP,
 				"region":        g.Dimensions.Region,
 				"fqdn":          g.Dimensions.Fqdn,
-			}).Add(float64(g.Count))
+			}, float64(g.Count))
+	}
+
+	// Failed checks are queried on their own, so dropping failure_reason
+	// doesn't hide them.
+	for _, g := range z.HealthCheckFailures {
+		b.add(zoneHealthCheckFailuresCountMetricName,
+			prometheus.Labels{
+				"zone":           name,
+				"account":        account,
+				"origin_ip":      g.Dimensions.OriginIP,
+				"region":         g.Dimensions.Region,
+				"fqdn":           g.Dimensions.Fqdn,
+				"failure_reason": g.Dimensions.FailureReason,
+				"status":         strconv.Itoa(int(g.Dimensions.OriginResponseStatus)),
+			}, float64(g.Count))
+	}
+
+	for _, g := range z.HealthCheckEventsRtt {
+		for quantile, ms := range map[string]float64{"P50": g.Quantiles.RttMsP50, "P95": g.Quantiles.RttMsP95, "P99": g.Quantiles.RttMsP99} {
+			rtt.add(zoneHealthCheckRTTMetricName,
+				prometheus.Labels{
+					"zone":      name,
+					"account":   account,
+					"origin_ip": g.Dimensions.OriginIP,
+					"region":    g.Dimensions.Region,
+					"fqdn":      g.Dimensions.Fqdn,
+					"quantile":  quantile,
+				}, ms/1000, g.Count)
+		}
 	}
 }
 
-func addHTTPAdaptiveGroups(z *zoneResp, name string, account string) {
+// addHealthChecks exports the standalone health checks of the zone from the
+// REST API, refreshed every inventory_ttl. A failed lookup is only counted as
+// a scrape error, the window's GraphQL data is kept.
+func addHealthChecks(ctx context.Context, b *metricBatch, zoneID string, name string, account string) {
+	if deniedMetrics.Has(zoneHealthCheckInfoMetricName) {
+		return
+	}
+	checks, err := inventoryFor(ctx).healthChecks(ctx, zoneID)
+	if err != nil {
+		log.Error("failed to fetch health checks for zone ", name, ": ", err)
+		recordScrapeError(ctx, datasetHealthChecks, name, account)
+	}
+	for _, c := range checks {
+		b.set(zoneHealthCheckInfoMetricName,
+			prometheus.Labels{
+				"zone":           name,
+				"account":        account,
+				"name":           c.Name,
+				"fqdn":           c.Address,
+				"type":           c.Type,
+				"interval":       strconv.Itoa(c.Interval),
+				"status":         c.Status,
+				"failure_reason": c.FailureReason,
+			}, 1)
+	}
+}
+
+func addHTTPAdaptiveGroups(b *metricBatch, z *zoneResp, name string, account string) {
 	for _, g := range z.HTTPRequestsAdaptiveGroups {
-		zoneRequestOriginStatusCountryHost.With(
+		b.add(zoneRequestOriginStatusCountryHostMetricName,
 			prometheus.Labels{
 				"zone":    name,
 				"account": account,
 				"status":  strconv.Itoa(int(g.Dimensions.OriginResponseStatus)),
 				"country": g.Dimensions.ClientCountryName,
 				"host":    g.Dimensions.ClientRequestHTTPHost,
-			}).Add(float64(g.Count))
+			}, float64(g.Count))
 	}
 
 	for _, g := range z.HTTPRequestsEdgeCountryHost {
-		zoneRequestStatusCountryHost.With(
+		b.add(zoneRequestStatusCountryHostMetricName,
 			prometheus.Labels{
 				"zone":    name,
 				"account": account,
 				"status":  strconv.Itoa(int(g.Dimensions.EdgeResponseStatus)),
 				"country": g.Dimensions.ClientCountryName,
 				"host":    g.Dimensions.ClientRequestHTTPHost,
-			}).Add(float64(g.Count))
+			}, float64(g.Count))
 	}
 }
 
-func fetchLoadBalancerAnalytics(zones []cloudflare.Zone, wg *sync.WaitGroup) {
-	wg.Add(1)
-	defer wg.Done()
-
-	// None of the below referenced metrics are available in the free tier
-	if viper.GetBool("free_tier") {
-		return
-	}
-
-	zoneIDs := extractZoneIDs(filterNonFreePlanZones(zones))
+func fetchLoadBalancerAnalytics(ctx context.Context, zones []cloudflare.Zone, w timeWindow, b *metricBatch) error {
+	zoneIDs := extractZoneIDs(zones)
 	if len(zoneIDs) == 0 {
-		return
+		return nil
 	}
 
-	l, err := fetchLoadBalancerTotals(zoneIDs)
+	l, truncated, err := fetchComplete(ctx, zoneIDs, w, fetchLoadBalancerTotals)
 	if err != nil {
-		return
+		recordZonesScrapeError(ctx, datasetLoadBalancer, zones)
+		return err
 	}
-	for _, lb := range l.Viewer.Zones {
+	recordZonesSuccessWindow(ctx, datasetLoadBalancer, zones, w)
+	recordZonesTruncated(ctx, datasetLoadBalancer, zones, truncated)
+
+	for _, lb := range l {
 		name, account := findZoneAccountName(zones, lb.ZoneTag)
 		lb := lb
-		addLoadBalancingRequestsAdaptive(&lb, name, account)
-		addLoadBalancingRequestsAdaptiveGroups(&lb, name, account)
+
+		recordGraphQLRows("loadBalancingRequestsAdaptiveGroups", len(lb.LoadBalancingRequestsAdaptiveGroups))
+		recordGraphQLRows("loadBalancingRequestsAdaptive", len(lb.LoadBalancingRequestsAdaptive))
+		addLoadBalancingRequestsAdaptive(b, &lb, name, account)
+		addLoadBalancingRequestsAdaptiveGroups(b, &lb, name, account)
 	}
+	return nil
 }
 
-func addLoadBalancingRequestsAdaptiveGroups(z *lbResp, name string, account string) {
+func addLoadBalancingRequestsAdaptiveGroups(b *metricBatch, z *lbResp, name string, account string) {
 	for _, g := range z.LoadBalancingRequestsAdaptiveGroups {
-		poolRequestsTotal.With(
+		b.add(poolRequestsTotalMetricName,
 			prometheus.Labels{
 				"zone":               name,
 				"account":            account,
 				"load_balancer_name": g.Dimensions.LbName,
 				"pool_name":          g.Dimensions.SelectedPoolName,
 				"origin_name":        g.Dimensions.SelectedOriginName,
-			}).Add(float64(g.Count))
+			}, float64(g.Count))
+		b.add(loadBalancerRequestsTotalMetricName,
+			prometheus.Labels{
+				"zone":               name,
+				"account":            account,
+				"load_balancer_name": g.Dimensions.LbName,
+				"steering_policy":    g.Dimensions.SteeringPolicy,
+				"session_affinity":   g.Dimensions.SessionAffinityStatus,
+				"proxied":            strconv.FormatBool(g.Dimensions.Proxied == 1),
+			}, float64(g.Count))
 	}
 }
 
-func addLoadBalancingRequestsAdaptive(z *lbResp, name string, account string) {
+func addLoadBalancingRequestsAdaptive(b *metricBatch, z *lbResp, name string, account string) {
 	for _, g := range z.LoadBalancingRequestsAdaptive {
 		for _, p := range g.Pools {
-			poolHealthStatus.With(
+			b.set(poolHealthStatusMetricName,
+				prometheus.Labels{
+					"zone":               name,
+					"account":            account,
+					"load_balancer_name": g.LbName,
+					"pool_name":          p.PoolName,
+				}, float64(p.Healthy))
+			b.set(poolAvgRTTMetricName,
 				prometheus.Labels{
 					"zone":               name,
 					"account":            account,
 					"load_balancer_name": g.LbName,
 					"pool_name":          p.PoolName,
-				}).Set(float64(p.Healthy))
+					"region":             g.Region,
+				}, float64(p.AvgRttMs)/1000)
+		}
+		// The origins are the ones of the pool selected for the request.
+		for _, o := range g.Origins {
+			b.set(poolOriginHealthStatusMetricName,
+				prometheus.Labels{
+					"zone":               name,
+					"account":            account,
+					"load_balancer_name": g.LbName,
+					"pool_name":          g.SelectedPoolName,
+					"origin_name":        o.OriginName,
+					"origin_ip":          o.IPv4,
+				}, float64(o.Health))
 		}
 	}
 }
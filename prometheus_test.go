@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/machinebox/graphql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+func TestAddHealthCheckGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		resp    string
+		dropped map[MetricName][]string
+		want    map[MetricName]int
+	}{
+		{
+			name: "rtt without events",
+			resp: `{"healthCheckEventsRtt": [{"quantiles": {"rttMsP50": 42, "rttMsP95": 87, "rttMsP99": 120}, "dimensions": {"originIP": "192.0.2.10", "region": "WEU", "fqdn": "origin.example.com"}}]}`,
+			want: map[MetricName]int{zoneHealthCheckRTTMetricName: 3},
+		},
+		{
+			name: "events and failures",
+			resp: `{
+				"healthCheckEventsAdaptiveGroups": [{"count": 4, "dimensions": {"healthStatus": "Healthy", "originIP": "192.0.2.10"}}],
+				"healthCheckFailures": [{"count": 1, "dimensions": {"originIP": "192.0.2.10", "failureReason": "TCP connection failed"}}]
+			}`,
+			want: map[MetricName]int{zoneHealthCheckEventsOriginCountMetricName: 1, zoneHealthCheckFailuresCountMetricName: 1},
+		},
+		{
+			name:    "failures with failure_reason dropped",
+			resp:    `{"healthCheckFailures": [{"count": 1, "dimensions": {"originIP": "192.0.2.10"}}]}`,
+			dropped: map[MetricName][]string{zoneHealthCheckFailuresCountMetricName: {"failure_reason"}},
+			want:    map[MetricName]int{zoneHealthCheckFailuresCountMetricName: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.dropped != nil {
+				droppedLabels = tt.dropped
+				defer func() { droppedLabels = map[MetricName][]string{} }()
+			}
+			var z zoneResp
+			if err := json.Unmarshal([]byte(tt.resp), &z); err != nil {
+				t.Fatal(err)
+			}
+
+			b := newMetricBatch(timeWindow{})
+			rtt := &weightedGauges{}
+			addHealthCheckGroups(b, rtt, &z, "example.com", "acc")
+			rtt.set(b)
+
+			got := map[MetricName]int{}
+			for _, s := range b.samples {
+				got[s.name]++
+				if s.name == zoneHealthCheckFailuresCountMetricName && tt.dropped != nil {
+					if _, ok := s.labels["failure_reason"]; ok {
+						t.Errorf("failure_reason not dropped: %v", s.labels)
+					}
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("samples = %v, want %v", got, tt.want)
+			}
+			for name, n := range tt.want {
+				if got[name] != n {
+					t.Errorf("%s samples = %d, want %d", name, got[name], n)
+				}
+			}
+		})
+	}
+}
+
+func TestWeightedGaugesSplitWindow(t *testing.T) {
+	// The halves of a window split after truncation, with 30 and 10 samples.
+	halves := []string{
+		`{"queueBacklogAdaptiveGroups": [{"count": 30, "dimensions": {"queueId": "q"}, "avg": {"messages": 10, "bytes": 100}}]}`,
+		`{"queueBacklogAdaptiveGroups": [{"count": 10, "dimensions": {"queueId": "q"}, "avg": {"messages": 50, "bytes": 500}}]}`,
+	}
+	avgs := &weightedGauges{}
+	for _, half := range halves {
+		var a accountResp
+		if err := json.Unmarshal([]byte(half), &a); err != nil {
+			t.Fatal(err)
+		}
+		for _, g := range a.QueueBacklogAdaptiveGroups {
+			avgs.add(queueBacklogMessagesMetricName, prometheus.Labels{"account": "acc", "queue_id": g.Dimensions.QueueID}, g.Avg.Messages, g.Count)
+			avgs.add(queueBacklogBytesMetricName, prometheus.Labels{"account": "acc", "queue_id": g.Dimensions.QueueID}, g.Avg.Bytes, g.Count)
+		}
+	}
+	b := newMetricBatch(timeWindow{})
+	avgs.set(b)
+
+	want := map[MetricName]float64{queueBacklogMessagesMetricName: 20, queueBacklogBytesMetricName: 200}
+	if len(b.samples) != len(want) {
+		t.Fatalf("samples = %v, want one per metric", b.samples)
+	}
+	for _, s := range b.samples {
+		if !s.set || s.value != want[s.name] {
+			t.Errorf("%s = %v (set %v), want %v", s.name, s.value, s.set, want[s.name])
+		}
+	}
+}
+
+func TestRESTOnlyDatasetsSkipGraphQL(t *testing.T) {
+	var queries atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		w.Write([]byte(`{"data": {}}`))
+	}))
+	defer server.Close()
+	initClients()
+	defer func(c *graphql.Client) { sharedGraphQL = c }(sharedGraphQL)
+	sharedGraphQL = graphql.NewClient(server.URL)
+
+	viper.Set("inventory_ttl", 3600)
+	defer viper.Set("inventory_ttl", nil)
+	defer func() { deniedMetrics = MetricsSet{} }()
+
+	// The REST data is already in the inventory, so nothing is fetched.
+	ctx := withTenant(context.Background(), &tenant{Name: "rest-only"})
+	defer cfInventories.retain(map[string]bool{})
+	inv := inventoryFor(ctx)
+	cachedFor(inv, inv.scripts, "acc", func() ([]cloudflare.WorkerMetaData, error) {
+		return []cloudflare.WorkerMetaData{{ID: "script"}}, nil
+	})
+	cachedFor(inv, inv.checks, "zone", func() ([]cloudflare.Healthcheck, error) {
+		return []cloudflare.Healthcheck{{Name: "check"}}, nil
+	})
+
+	tests := []struct {
+		name    string
+		dataset string
+		fetch   func(b *metricBatch) error
+		want    MetricName
+	}{
+		{
+			name:    "workers",
+			dataset: datasetWorkers,
+			fetch: func(b *metricBatch) error {
+				return fetchWorkerAnalytics(ctx, cloudflare.Account{ID: "acc", Name: "acc"}, timeWindow{}, b)
+			},
+			want: workerScriptInfoMetricName,
+		},
+		{
+			name:    "zone totals",
+			dataset: datasetZoneTotals,
+			fetch: func(b *metricBatch) error {
+				return fetchZoneAnalytics(ctx, []cloudflare.Zone{testZone("zone", "free", "active", false)}, timeWindow{}, b)
+			},
+			want: zoneHealthCheckInfoMetricName,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deniedMetrics = MetricsSet{}
+			for _, def := range metricDefs {
+				if def.dataset == tt.dataset && def.node != "" {
+					deniedMetrics.Add(def.name)
+				}
+			}
+			queries.Store(0)
+
+			b := newTenantBatch(timeWindow{}, &tenant{Name: "rest-only"})
+			if err := tt.fetch(b); err != nil {
+				t.Fatal(err)
+			}
+			if n := queries.Load(); n != 0 {
+				t.Errorf("sent %d GraphQL queries, want none", n)
+			}
+			if len(b.samples) != 1 || b.samples[0].name != tt.want {
+				t.Errorf("samples = %v, want one %s", b.samples, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/proto"
+)
+
+// relabelConfig is a rule of the relabel_configs section of the config
+// file, with the fields and defaults of Prometheus' relabel_config.
+type relabelConfig struct {
+	SourceLabels []string `mapstructure:"source_labels"`
+	Separator    *string  `mapstructure:"separator"`
+	TargetLabel  string   `mapstructure:"target_label"`
+	Regex        *string  `mapstructure:"regex"`
+	Modulus      uint64   `mapstructure:"modulus"`
+	Replacement  *string  `mapstructure:"replacement"`
+	Action       string   `mapstructure:"action"`
+}
+
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelMap  = "labelmap"
+	relabelHashMod   = "hashmod"
+	relabelLowercase = "lowercase"
+)
+
+// relabelRule is a validated relabelConfig.
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	targetLabel  string
+	regex        *regexp.Regexp
+	modulus      uint64
+	replacement  string
+	action       string
+}
+
+// relabelRules holds the relabel rules in use. They're compiled at startup and
+// on each successful config reload, scrapes only load them.
+var relabelRules atomic.Pointer[[]relabelRule]
+
+// storeRelabelRules compiles the relabel_configs of the config file and makes
+// them the rules in use.
+func storeRelabelRules() error {
+	rules, err := loadRelabelRules()
+	if err != nil {
+		return err
+	}
+	relabelRules.Store(&rules)
+	return nil
+}
+
+// loadRelabelRules validates the relabel_configs of the config file.
+func loadRelabelRules() ([]relabelRule, error) {
+	var configs []relabelConfig
+	if err := viper.UnmarshalKey("relabel_configs", &configs); err != nil {
+		return nil, err
+	}
+
+	rules := make([]relabelRule, 0, len(configs))
+	for i, c := range configs {
+		r := relabelRule{
+			sourceLabels: c.SourceLabels,
+			separator:    ";",
+			targetLabel:  c.TargetLabel,
+			modulus:      c.Modulus,
+			replacement:  "$1",
+			action:       strings.ToLower(c.Action),
+		}
+		if c.Separator != nil {
+			r.separator = *c.Separator
+		}
+		if c.Replacement != nil {
+			r.replacement = *c.Replacement
+		}
+		if r.action == "" {
+			r.action = relabelReplace
+		}
+		regex := "(.*)"
+		if c.Regex != nil {
+			regex = *c.Regex
+		}
+		re, err := regexp.Compile("^(?:" + regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel config %d: invalid regex: %w", i, err)
+		}
+		r.regex = re
+
+		switch r.action {
+		case relabelReplace, relabelHashMod, relabelLowercase:
+			if r.targetLabel == "" {
+				return nil, fmt.Errorf("relabel config %d: %s needs a target_label", i, r.action)
+			}
+			if r.targetLabel == model.MetricNameLabel {
+				return nil, fmt.Errorf("relabel config %d: metrics can't be renamed", i)
+			}
+			if !strings.Contains(r.targetLabel, "$") && !model.LabelName(r.targetLabel).IsValid() {
+				return nil, fmt.Errorf("relabel config %d: target_label %s is invalid", i, r.targetLabel)
+			}
+			if r.action == relabelHashMod && r.modulus == 0 {
+				return nil, fmt.Errorf("relabel config %d: hashmod needs a modulus", i)
+			}
+		case relabelKeep, relabelDrop, relabelLabelMap:
+		default:
+			return nil, fmt.Errorf("relabel config %d: action %s doesn't exist, must be one of replace, keep, drop, labelmap, hashmod, lowercase", i, c.Action)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// relabel applies rules to labels in order. It returns false when the series
+// is dropped.
+func relabel(rules []relabelRule, labels map[string]string) bool {
+	for _, r := range rules {
+		values := make([]string, 0, len(r.sourceLabels))
+		for _, name := range r.sourceLabels {
+			values = append(values, labels[name])
+		}
+		val := strings.Join(values, r.separator)
+
+		switch r.action {
+		case relabelKeep:
+			if !r.regex.MatchString(val) {
+				return false
+			}
+		case relabelDrop:
+			if r.regex.MatchString(val) {
+				return false
+			}
+		case relabelReplace:
+			match := r.regex.FindStringSubmatchIndex(val)
+			if match == nil {
+				continue
+			}
+			target := string(r.regex.ExpandString(nil, r.targetLabel, val, match))
+			if !model.LabelName(target).IsValid() || target == model.MetricNameLabel {
+				continue
+			}
+			if res := string(r.regex.ExpandString(nil, r.replacement, val, match)); res != "" {
+				labels[target] = res
+			} else {
+				delete(labels, target)
+			}
+		case relabelLowercase:
+			labels[r.targetLabel] = strings.ToLower(val)
+		case relabelHashMod:
+			sum := md5.Sum([]byte(val))
+			labels[r.targetLabel] = strconv.FormatUint(binary.BigEndian.Uint64(sum[8:])%r.modulus, 10)
+		case relabelLabelMap:
+			mapped := map[string]string{}
+			for name, value := range labels {
+				if r.regex.MatchString(name) {
+					mapped[r.regex.ReplaceAllString(name, r.replacement)] = value
+				}
+			}
+			for name, value := range mapped {
+				labels[name] = value
+			}
+		}
+	}
+	return true
+}
+
+// relabelGatherer relabels every series gathered from next with the rules in
+// use. Series whose labels become identical are merged: counters, gauges and
+// histograms are summed, colliding summaries fail the scrape as their
+// quantiles can't be combined.
+type relabelGatherer struct {
+	next  prometheus.Gatherer
+	rules *atomic.Pointer[[]relabelRule]
+}
+
+func (g relabelGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.next.Gather()
+
+	rules := g.rules.Load()
+	if rules == nil || len(*rules) == 0 {
+		return families, err
+	}
+
+	relabeled := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		var metrics []*dto.Metric
+		seen := map[string]*dto.Metric{}
+		for _, m := range mf.Metric {
+			labels := map[string]string{model.MetricNameLabel: mf.GetName()}
+			for _, lp := range m.Label {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if !relabel(*rules, labels) {
+				continue
+			}
+
+			m.Label = labelPairs(labels)
+			key := labelsKey(m.Label)
+			if first, ok := seen[key]; ok {
+				if merr := mergeMetric(first, m); merr != nil {
+					return nil, fmt.Errorf("relabeling %s: %w", mf.GetName(), merr)
+				}
+				continue
+			}
+			seen[key] = m
+			metrics = append(metrics, m)
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			relabeled = append(relabeled, mf)
+		}
+	}
+	return relabeled, err
+}
+
+// labelPairs returns the labels sorted by name, leaving out reserved labels
+// starting with __, which relabel configs can use as temporary labels.
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for name, value := range labels {
+		if strings.HasPrefix(name, model.ReservedLabelPrefix) || value == "" {
+			continue
+		}
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+	return pairs
+}
+
+func labelsKey(pairs []*dto.LabelPair) string {
+	var key strings.Builder
+	for _, lp := range pairs {
+		key.WriteString(lp.GetName())
+		key.WriteByte(0)
+		key.WriteString(lp.GetValue())
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+// mergeMetric adds m to into, both of the same type. Histograms are merged
+// bucket by bucket and need the same bucket bounds.
+func mergeMetric(into *dto.Metric, m *dto.Metric) error {
+	switch {
+	case into.Counter != nil && m.Counter != nil:
+		into.Counter.Value = proto.Float64(into.Counter.GetValue() + m.Counter.GetValue())
+	case into.Gauge != nil && m.Gauge != nil:
+		into.Gauge.Value = proto.Float64(into.Gauge.GetValue() + m.Gauge.GetValue())
+	case into.Untyped != nil && m.Untyped != nil:
+		into.Untyped.Value = proto.Float64(into.Untyped.GetValue() + m.Untyped.GetValue())
+	case into.Histogram != nil && m.Histogram != nil:
+		return mergeHistogram(into.Histogram, m.Histogram)
+	case into.Summary != nil && m.Summary != nil:
+		return errors.New("summary series with identical labels can't be merged")
+	default:
+		return errors.New("series with identical labels have different types")
+	}
+	return nil
+}
+
+func mergeHistogram(into *dto.Histogram, h *dto.Histogram) error {
+	if len(into.Bucket) != len(h.Bucket) {
+		return errors.New("histogram series with identical labels have different buckets")
+	}
+	for i, b := range h.Bucket {
+		if into.Bucket[i].GetUpperBound() != b.GetUpperBound() {
+			return errors.New("histogram series with identical labels have different buckets")
+		}
+	}
+	for i, b := range h.Bucket {
+		into.Bucket[i].CumulativeCount = proto.Uint64(into.Bucket[i].GetCumulativeCount() + b.GetCumulativeCount())
+	}
+	into.SampleCount = proto.Uint64(into.GetSampleCount() + h.GetSampleCount())
+	into.SampleSum = proto.Float64(into.GetSampleSum() + h.GetSampleSum())
+	return nil
+}
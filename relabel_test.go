@@ -0,0 +1,283 @@
+package main
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/proto"
+)
+
+func mustRelabelRules(t *testing.T, configs []map[string]interface{}) []relabelRule {
+	t.Helper()
+	viper.Set("relabel_configs", configs)
+	t.Cleanup(func() { viper.Set("relabel_configs", nil) })
+	rules, err := loadRelabelRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestRelabel(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []map[string]interface{}
+		input   map[string]string
+		output  map[string]string
+	}{
+		{
+			name: "replace with the default regex and replacement",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a"}, "target_label": "d"},
+			},
+			input:  map[string]string{"a": "foo"},
+			output: map[string]string{"a": "foo", "d": "foo"},
+		},
+		{
+			name: "replace with groups and separator",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a", "b"}, "separator": "/", "regex": "f(.*)/(.*)", "target_label": "d", "replacement": "$2-$1"},
+			},
+			input:  map[string]string{"a": "foo", "b": "bar"},
+			output: map[string]string{"a": "foo", "b": "bar", "d": "bar-oo"},
+		},
+		{
+			name: "replace without a match leaves the labels",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a"}, "regex": "bar", "target_label": "d", "replacement": "x"},
+			},
+			input:  map[string]string{"a": "foo"},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			name: "replace with an anchored regex",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a"}, "regex": "o", "target_label": "d", "replacement": "x"},
+			},
+			input:  map[string]string{"a": "foo"},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			name: "replace with an empty result deletes the target",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a"}, "target_label": "b", "replacement": ""},
+			},
+			input:  map[string]string{"a": "foo", "b": "bar"},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			name: "replace with a templated target label",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a"}, "regex": "(.*)=(.*)", "target_label": "${1}", "replacement": "${2}"},
+			},
+			input:  map[string]string{"a": "b=c"},
+			output: map[string]string{"a": "b=c", "b": "c"},
+		},
+		{
+			name: "keep on a match",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a"}, "regex": "f.*", "action": "keep"},
+			},
+			input:  map[string]string{"a": "foo"},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			name: "keep drops without a match",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a"}, "regex": "b.*", "action": "keep"},
+			},
+			input: map[string]string{"a": "foo"},
+		},
+		{
+			name: "drop on a match",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"__name__", "a"}, "regex": "cloudflare_.*;foo", "action": "drop"},
+			},
+			input: map[string]string{"__name__": "cloudflare_zone_requests_total", "a": "foo"},
+		},
+		{
+			name: "drop keeps without a match",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a"}, "regex": "bar", "action": "drop"},
+			},
+			input:  map[string]string{"a": "foo"},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			name: "labelmap copies matching labels",
+			configs: []map[string]interface{}{
+				{"regex": "(a|b)", "replacement": "x_$1", "action": "labelmap"},
+			},
+			input:  map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			output: map[string]string{"a": "foo", "b": "bar", "c": "baz", "x_a": "foo", "x_b": "bar"},
+		},
+		{
+			name: "hashmod matches Prometheus",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"c"}, "target_label": "d", "modulus": 1000, "action": "hashmod"},
+			},
+			input:  map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			output: map[string]string{"a": "foo", "b": "bar", "c": "baz", "d": "976"},
+		},
+		{
+			name: "lowercase",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a", "b"}, "target_label": "d", "action": "lowercase"},
+			},
+			input:  map[string]string{"a": "FoO", "b": "BAR"},
+			output: map[string]string{"a": "FoO", "b": "BAR", "d": "foo;bar"},
+		},
+		{
+			name: "rules apply in order",
+			configs: []map[string]interface{}{
+				{"source_labels": []string{"a"}, "target_label": "__tmp", "action": "lowercase"},
+				{"source_labels": []string{"__tmp"}, "regex": "foo", "action": "keep"},
+			},
+			input:  map[string]string{"a": "FOO"},
+			output: map[string]string{"a": "FOO", "__tmp": "foo"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := mustRelabelRules(t, tt.configs)
+			labels := map[string]string{}
+			for k, v := range tt.input {
+				labels[k] = v
+			}
+			kept := relabel(rules, labels)
+			if kept != (tt.output != nil) {
+				t.Fatalf("relabel() kept = %v, want %v", kept, tt.output != nil)
+			}
+			if kept && !reflect.DeepEqual(labels, tt.output) {
+				t.Errorf("relabel() labels = %v, want %v", labels, tt.output)
+			}
+		})
+	}
+}
+
+func TestLoadRelabelRulesInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+	}{
+		{"unknown action", map[string]interface{}{"action": "rename"}},
+		{"invalid regex", map[string]interface{}{"source_labels": []string{"a"}, "target_label": "b", "regex": "("}},
+		{"replace without target", map[string]interface{}{"source_labels": []string{"a"}}},
+		{"rename metric", map[string]interface{}{"source_labels": []string{"a"}, "target_label": "__name__"}},
+		{"invalid target", map[string]interface{}{"source_labels": []string{"a"}, "target_label": "0a"}},
+		{"hashmod without modulus", map[string]interface{}{"source_labels": []string{"a"}, "target_label": "b", "action": "hashmod"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("relabel_configs", []map[string]interface{}{tt.config})
+			defer viper.Set("relabel_configs", nil)
+			if _, err := loadRelabelRules(); err == nil {
+				t.Error("loadRelabelRules() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func labelPair(name, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+}
+
+func histogram(count uint64, sum float64, buckets ...uint64) *dto.Histogram {
+	h := &dto.Histogram{SampleCount: proto.Uint64(count), SampleSum: proto.Float64(sum)}
+	for i, c := range buckets {
+		h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: proto.Float64(float64(i + 1)), CumulativeCount: proto.Uint64(c)})
+	}
+	return h
+}
+
+func TestRelabelGathererMerge(t *testing.T) {
+	families := func() []*dto.MetricFamily {
+		return []*dto.MetricFamily{
+			{
+				Name: proto.String("cloudflare_zone_requests_total"),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{Label: []*dto.LabelPair{labelPair("host", "a"), labelPair("zone", "z")}, Counter: &dto.Counter{Value: proto.Float64(1)}},
+					{Label: []*dto.LabelPair{labelPair("host", "b"), labelPair("zone", "z")}, Counter: &dto.Counter{Value: proto.Float64(2)}},
+				},
+			},
+			{
+				Name: proto.String("cloudflare_zone_latency"),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{Label: []*dto.LabelPair{labelPair("host", "a")}, Histogram: histogram(3, 2.5, 1, 3)},
+					{Label: []*dto.LabelPair{labelPair("host", "b")}, Histogram: histogram(4, 3, 2, 4)},
+				},
+			},
+		}
+	}
+	var rules atomic.Pointer[[]relabelRule]
+	g := relabelGatherer{next: prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return families(), nil }), rules: &rules}
+
+	got, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got[0].Metric) != 2 {
+		t.Fatalf("without rules got %d series, want 2", len(got[0].Metric))
+	}
+
+	loaded := mustRelabelRules(t, []map[string]interface{}{
+		{"source_labels": []string{"host"}, "target_label": "host", "replacement": ""},
+	})
+	rules.Store(&loaded)
+	got, err = g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got[0].Metric) != 1 || got[0].Metric[0].GetCounter().GetValue() != 3 {
+		t.Errorf("counters = %v, want one series summing to 3", got[0].Metric)
+	}
+	if len(got[1].Metric) != 1 {
+		t.Fatalf("histograms = %v, want one series", got[1].Metric)
+	}
+	if want := histogram(7, 5.5, 3, 7); !proto.Equal(got[1].Metric[0].GetHistogram(), want) {
+		t.Errorf("histogram = %v, want %v", got[1].Metric[0].GetHistogram(), want)
+	}
+}
+
+func TestRelabelGathererMergeFails(t *testing.T) {
+	tests := []struct {
+		name    string
+		metrics []*dto.Metric
+	}{
+		{
+			name: "summaries",
+			metrics: []*dto.Metric{
+				{Label: []*dto.LabelPair{labelPair("host", "a")}, Summary: &dto.Summary{SampleCount: proto.Uint64(1)}},
+				{Label: []*dto.LabelPair{labelPair("host", "b")}, Summary: &dto.Summary{SampleCount: proto.Uint64(1)}},
+			},
+		},
+		{
+			name: "histogram buckets",
+			metrics: []*dto.Metric{
+				{Label: []*dto.LabelPair{labelPair("host", "a")}, Histogram: histogram(1, 1, 1)},
+				{Label: []*dto.LabelPair{labelPair("host", "b")}, Histogram: histogram(1, 1, 1, 1)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := mustRelabelRules(t, []map[string]interface{}{
+				{"source_labels": []string{"host"}, "target_label": "host", "replacement": ""},
+			})
+			var current atomic.Pointer[[]relabelRule]
+			current.Store(&rules)
+			g := relabelGatherer{next: prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+				return []*dto.MetricFamily{{Name: proto.String("cloudflare_test"), Metric: tt.metrics}}, nil
+			}), rules: &current}
+			if _, err := g.Gather(); err == nil {
+				t.Error("Gather() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -2,9 +2,22 @@
 export basePort="8081"
 export metricsPath='/metrics'
 export baseUrl="localhost:${basePort}"
+export mockUrl="localhost:8082"
 
-source .env
-# Test if we have cloudflare api/key variables configured.
+# Test against the real Cloudflare API when credentials are configured in
+# .env, otherwise against the bundled fake API serving tests/fixtures.
+if [ -f .env ]; then
+  source .env
+else
+  go build -o /tmp/cloudflare-exporter-mockserver ./tests/mockserver
+  nohup /tmp/cloudflare-exporter-mockserver --listen="${mockUrl}" --fixtures=tests/fixtures >/tmp/cloudflare-exporter-mockserver.out 2>&1 &
+  export mockPid=$!
+
+  export CF_API_TOKEN="mock-token"
+  export CF_API_BASE_URL="http://${mockUrl}/client/v4"
+  export CF_GRAPHQL_ENDPOINT="http://${mockUrl}/client/v4/graphql/"
+  sleep 1
+fi
 
 # Run cloudflare-exporter
 nohup ./cloudflare_exporter --listen="${baseUrl}" >/tmp/cloudflare-exporter-test.out 2>&1 &
@@ -20,3 +33,6 @@ venom run tests/basic_tests.yml
 # Cleanup
 rm venom*.log
 kill ${pid}
+if [ -n "${mockPid}" ]; then
+  kill ${mockPid}
+fi
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// scheduler starts a collection cycle every interval. Cycles never overlap,
+// a tick arriving while the previous cycle still runs is skipped.
+type scheduler struct {
+	interval time.Duration
+	collect  func(ctx context.Context)
+
+	running atomic.Bool
+	wg      sync.WaitGroup
+}
+
+func newScheduler(interval time.Duration, collect func(ctx context.Context)) *scheduler {
+	return &scheduler{
+		interval: interval,
+		collect:  collect,
+	}
+}
+
+// run blocks until ctx is cancelled and the running cycle, if any, finished.
+func (s *scheduler) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.tick(ctx)
+
+		select {
+		case <-ctx.Done():
+			s.wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *scheduler) tick(ctx context.Context) {
+	if !s.running.CompareAndSwap(false, true) {
+		log.Warn("previous collection cycle still running, skipping this one")
+		exporterSkippedCycles.Inc()
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.running.Store(false)
+		s.collect(ctx)
+	}()
+}
+
+// runJobs runs jobs with at most concurrency of them in flight. Jobs not yet
+// started when ctx is cancelled are dropped. It reports whether any job
+// failed or was dropped.
+func runJobs(ctx context.Context, concurrency int, jobs []func(ctx context.Context) error) bool {
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+
+	sem := make(chan struct{}, concurrency)
+	for _, job := range jobs {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return true
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(job func(ctx context.Context) error) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := job(ctx); err != nil {
+				failed.Store(true)
+			}
+		}(job)
+	}
+
+	wg.Wait()
+	return failed.Load()
+}
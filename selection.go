@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+)
+
+var (
+	zonePlans    = []string{"free", "pro", "business", "enterprise"}
+	zoneStatuses = []string{"active", "pending", "initializing", "moved", "deleted", "deactivated"}
+)
+
+// zoneSelection picks zones by name, plan, status and paused flag. Empty
+// rules match every zone.
+type zoneSelection struct {
+	names        []*regexp.Regexp
+	excludeNames []*regexp.Regexp
+	plans        []string
+	statuses     []string
+	paused       *bool
+}
+
+func newZoneSelection(t *tenant) (*zoneSelection, error) {
+	s := &zoneSelection{plans: t.ZonePlans, statuses: t.ZoneStatuses, paused: t.ZonePaused}
+	for _, p := range t.ZoneNames {
+		re, err := compileZonePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		s.names = append(s.names, re)
+	}
+	for _, p := range t.ExcludeZoneNames {
+		re, err := compileZonePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		s.excludeNames = append(s.excludeNames, re)
+	}
+	for _, plan := range s.plans {
+		if !contains(zonePlans, plan) {
+			return nil, fmt.Errorf("zone plan %s doesn't exist, must be one of %s", plan, strings.Join(zonePlans, ", "))
+		}
+	}
+	for _, status := range s.statuses {
+		if !contains(zoneStatuses, status) {
+			return nil, fmt.Errorf("zone status %s doesn't exist, must be one of %s", status, strings.Join(zoneStatuses, ", "))
+		}
+	}
+	return s, nil
+}
+
+// compileZonePattern compiles a zone name pattern. Patterns starting with ~
+// are regular expressions, others are globs where * matches any sequence of
+// characters and ? a single one. Both ignore case.
+func compileZonePattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := strings.CutPrefix(pattern, "~"); ok {
+		compiled, err := regexp.Compile("(?i)" + re)
+		if err != nil {
+			return nil, fmt.Errorf("zone name pattern %s: %w", pattern, err)
+		}
+		return compiled, nil
+	}
+
+	glob := regexp.QuoteMeta(strings.ToLower(pattern))
+	glob = strings.ReplaceAll(glob, `\*`, ".*")
+	glob = strings.ReplaceAll(glob, `\?`, ".")
+	return regexp.MustCompile("^" + glob + "$"), nil
+}
+
+func (s *zoneSelection) matches(z cloudflare.Zone) bool {
+	if len(s.names) > 0 && !matchesAny(s.names, z.Name) {
+		return false
+	}
+	if matchesAny(s.excludeNames, z.Name) {
+		return false
+	}
+	if len(s.plans) > 0 && !contains(s.plans, z.Plan.LegacyID) {
+		return false
+	}
+	if len(s.statuses) > 0 && !contains(s.statuses, z.Status) {
+		return false
+	}
+	return s.paused == nil || *s.paused == z.Paused
+}
+
+func matchesAny(patterns []*regexp.Regexp, name string) bool {
+	for _, re := range patterns {
+		if re.MatchString(strings.ToLower(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the zones matching s.
+func (s *zoneSelection) filter(zones []cloudflare.Zone) []cloudflare.Zone {
+	var filtered []cloudflare.Zone
+	for _, z := range zones {
+		if s.matches(z) {
+			filtered = append(filtered, z)
+		}
+	}
+	return filtered
+}
+
+// parseOptionalBool parses a true or false setting, empty meaning either.
+func parseOptionalBool(name string, s string) (*bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true, false or empty", name)
+	}
+	return &b, nil
+}
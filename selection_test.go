@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	cloudflare "github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCompileZonePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"example.com", "exampleXcom", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"example.?o", "example.io", true},
+		{"example.?o", "example.com", false},
+		{"Example.COM", "example.com", true},
+		{"example.com", "EXAMPLE.com", true},
+		{"~^api\\.", "api.example.com", true},
+		{"~^api\\.", "www.api.example.com", false},
+		{"~example", "www.example.com", true},
+		{"~^API\\.", "api.example.com", true},
+		{"~\\.(com|io)$", "example.io", true},
+		{"~\\.(com|io)$", "example.org", false},
+	}
+	for _, tt := range tests {
+		re, err := compileZonePattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("compileZonePattern(%q) error: %v", tt.pattern, err)
+		}
+		if got := matchesAny([]*regexp.Regexp{re}, tt.name); got != tt.want {
+			t.Errorf("pattern %q matches %q = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := compileZonePattern("~("); err == nil {
+		t.Error("compileZonePattern(\"~(\") succeeded, want an error")
+	}
+}
+
+func testZone(name string, plan string, status string, paused bool) cloudflare.Zone {
+	z := cloudflare.Zone{ID: name, Name: name, Status: status, Paused: paused}
+	z.Plan.LegacyID = plan
+	return z
+}
+
+func TestZoneSelectionFilter(t *testing.T) {
+	yes := true
+	zones := []cloudflare.Zone{
+		testZone("example.com", "free", "active", false),
+		testZone("api.example.com", "enterprise", "active", false),
+		testZone("Shop.Example.io", "pro", "pending", false),
+		testZone("old.example.org", "business", "active", true),
+	}
+	tests := []struct {
+		name   string
+		tenant tenant
+		want   []string
+	}{
+		{
+			name: "no rules",
+			want: []string{"example.com", "api.example.com", "Shop.Example.io", "old.example.org"},
+		},
+		{
+			name:   "glob",
+			tenant: tenant{ZoneNames: []string{"*.example.com"}},
+			want:   []string{"api.example.com"},
+		},
+		{
+			name:   "globs ignore case",
+			tenant: tenant{ZoneNames: []string{"shop.example.*"}},
+			want:   []string{"Shop.Example.io"},
+		},
+		{
+			name:   "regex",
+			tenant: tenant{ZoneNames: []string{"~\\.(com|io)$"}},
+			want:   []string{"example.com", "api.example.com", "Shop.Example.io"},
+		},
+		{
+			name:   "exclude",
+			tenant: tenant{ZoneNames: []string{"~example"}, ExcludeZoneNames: []string{"~^(api|SHOP)\\."}},
+			want:   []string{"example.com", "old.example.org"},
+		},
+		{
+			name:   "plan and status",
+			tenant: tenant{ZonePlans: []string{"free", "pro", "business"}, ZoneStatuses: []string{"active"}},
+			want:   []string{"example.com", "old.example.org"},
+		},
+		{
+			name:   "paused",
+			tenant: tenant{ZonePaused: &yes},
+			want:   []string{"old.example.org"},
+		},
+		{
+			name:   "nothing matches",
+			tenant: tenant{ZoneNames: []string{"*.example.net"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newZoneSelection(&tt.tenant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, z := range s.filter(zones) {
+				got = append(got, z.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewZoneSelectionInvalid(t *testing.T) {
+	for _, tt := range []tenant{
+		{ZoneNames: []string{"~("}},
+		{ExcludeZoneNames: []string{"~["}},
+		{ZonePlans: []string{"premium"}},
+		{ZoneStatuses: []string{"gone"}},
+	} {
+		if _, err := newZoneSelection(&tt); err == nil {
+			t.Errorf("newZoneSelection(%+v) succeeded, want an error", tt)
+		}
+	}
+}
+
+func collectedSeries(c prometheus.Collector) int {
+	ch := make(chan prometheus.Metric, 100)
+	c.Collect(ch)
+	close(ch)
+	return len(ch)
+}
+
+func TestRecordSelectedZones(t *testing.T) {
+	tn := &tenant{Name: "default"}
+	a := testZone("a.example.com", "free", "active", false)
+	b := testZone("b.example.com", "free", "active", false)
+
+	recordSelectedZones([]tenantScope{{tenant: tn, zones: []cloudflare.Zone{a, b}}})
+	if n := collectedSeries(exporterSelectedZones); n != 2 {
+		t.Fatalf("selected zones = %d, want 2", n)
+	}
+	b.Plan.LegacyID = "pro"
+	recordSelectedZones([]tenantScope{{tenant: tn, zones: []cloudflare.Zone{b}}})
+	if n := collectedSeries(exporterSelectedZones); n != 1 {
+		t.Errorf("selected zones = %d, want 1 after a and b's old plan went away", n)
+	}
+}
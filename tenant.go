@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/machinebox/graphql"
+	"github.com/spf13/viper"
+)
+
+// tenantLabel is added to every Cloudflare metric, naming the credential
+// profile the data was fetched with.
+const tenantLabel = "tenant"
+
+// tenant is a Cloudflare credential profile with its own account and zone
+// selection.
+type tenant struct {
+	Name            string   `mapstructure:"name"`
+	APIToken        string   `mapstructure:"api_token"`
+	APIKey          string   `mapstructure:"api_key"`
+	APIEmail        string   `mapstructure:"api_email"`
+	Accounts        []string `mapstructure:"accounts"`
+	ExcludeAccounts []string `mapstructure:"exclude_accounts"`
+	Zones           []string `mapstructure:"zones"`
+	ExcludeZones    []string `mapstructure:"exclude_zones"`
+
+	ZoneNames        []string `mapstructure:"zone_names"`
+	ExcludeZoneNames []string `mapstructure:"exclude_zone_names"`
+	ZonePlans        []string `mapstructure:"zone_plans"`
+	ZoneStatuses     []string `mapstructure:"zone_status"`
+	ZonePaused       *bool    `mapstructure:"zone_paused"`
+}
+
+// loadTenants returns the tenants of the config file. Without any, the
+// credentials, account and zone selection of the flags make up a single tenant.
+func loadTenants() ([]*tenant, error) {
+	var tenants []*tenant
+	if err := viper.UnmarshalKey("tenants", &tenants); err != nil {
+		return nil, err
+	}
+	if len(tenants) > 0 {
+		return tenants, nil
+	}
+
+	paused, err := parseOptionalBool("CF_ZONE_PAUSED", viper.GetString("cf_zone_paused"))
+	if err != nil {
+		return nil, err
+	}
+	return []*tenant{{
+		Name:            viper.GetString("tenant"),
+		APIToken:        viper.GetString("cf_api_token"),
+		APIKey:          viper.GetString("cf_api_key"),
+		APIEmail:        viper.GetString("cf_api_email"),
+		Accounts:        splitList(viper.GetString("cf_accounts")),
+		ExcludeAccounts: splitList(viper.GetString("cf_exclude_accounts")),
+		Zones:           getTargetZones(),
+		ExcludeZones:    getExcludedZones(),
+
+		ZoneNames:        splitList(viper.GetString("cf_zone_names")),
+		ExcludeZoneNames: splitList(viper.GetString("cf_exclude_zone_names")),
+		ZonePlans:        splitList(viper.GetString("cf_zone_plans")),
+		ZoneStatuses:     splitList(viper.GetString("cf_zone_status")),
+		ZonePaused:       paused,
+	}}, nil
+}
+
+func validateTenants(tenants []*tenant) error {
+	names := map[string]bool{}
+	for _, t := range tenants {
+		if t.Name == "" {
+			return errors.New("every tenant needs a name")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("tenant %s is configured twice", t.Name)
+		}
+		names[t.Name] = true
+		if !(len(t.APIToken) > 0 || (len(t.APIEmail) > 0 && len(t.APIKey) > 0)) {
+			if len(tenants) == 1 {
+				return errors.New("please provide CF_API_KEY+CF_API_EMAIL or CF_API_TOKEN")
+			}
+			return fmt.Errorf("tenant %s needs api_token or api_key and api_email", t.Name)
+		}
+		if _, err := newZoneSelection(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retainTenants drops the inventories and rate limiters of tenants removed
+// from the configuration, so their series and buckets don't outlive them.
+func retainTenants(tenants []*tenant) {
+	names := map[string]bool{}
+	for _, t := range tenants {
+		names[t.Name] = true
+	}
+	cfInventories.retain(names)
+	retainClientTenants(names)
+}
+
+type tenantContextKey struct{}
+
+// withTenant makes API calls made with ctx authenticate as t.
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, t)
+}
+
+func tenantFromContext(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantContextKey{}).(*tenant)
+	if t == nil {
+		return &tenant{}
+	}
+	return t
+}
+
+// setGraphQLAuth authenticates request as the tenant of ctx.
+func setGraphQLAuth(ctx context.Context, request *graphql.Request) {
+	t := tenantFromContext(ctx)
+	if len(t.APIToken) > 0 {
+		request.Header.Set("Authorization", "Bearer "+t.APIToken)
+	} else {
+		request.Header.Set("X-AUTH-EMAIL", t.APIEmail)
+		request.Header.Set("X-AUTH-KEY", t.APIKey)
+	}
+}
@@ -0,0 +1,183 @@
+// Command mockserver is a fake Cloudflare API used by the end-to-end tests.
+//
+// It serves the REST endpoints the exporter relies on (zones, accounts,
+// firewall rules and rulesets) and the GraphQL analytics endpoint from
+// fixture files, so the exporter can be exercised without network access or
+// real credentials.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// graphqlFixtures maps a dataset queried by the exporter to the fixture
+// answering it. The first dataset found in the query wins, so the more
+// specific entries are listed first.
+var graphqlFixtures = []struct {
+	dataset string
+	scope   string
+	fixture string
+}{
+	{"settings", "zones", "zone_settings.json"},
+	{"settings", "accounts", "account_settings.json"},
+	{"httpRequests1mGroups", "zones", "zone_totals.json"},
+	{"workersInvocationsAdaptive", "accounts", "worker_totals.json"},
+	{"workersSubrequestsAdaptiveGroups", "accounts", "worker_subrequests.json"},
+	{"workersInvocationsScheduled", "accounts", "worker_scheduled.json"},
+	{"queueBacklogAdaptiveGroups", "accounts", "queues.json"},
+	{"loadBalancingRequestsAdaptive", "zones", "load_balancer_totals.json"},
+	{"logpushHealthAdaptiveGroups", "accounts", "logpush_account.json"},
+	{"logpushHealthAdaptiveGroups", "zones", "logpush_zone.json"},
+	{"httpRequestsAdaptiveGroups", "zones", "colo_totals.json"},
+}
+
+type graphqlRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type server struct {
+	fixtures string
+	throttle int
+
+	mu       sync.Mutex
+	requests int
+}
+
+// throttled answers every throttle-th request with 429 and Retry-After, to
+// exercise the exporter's retries.
+func (s *server) throttled(w http.ResponseWriter) bool {
+	if s.throttle < 1 {
+		return false
+	}
+	s.mu.Lock()
+	s.requests++
+	n := s.requests
+	s.mu.Unlock()
+	if n%s.throttle != 0 {
+		return false
+	}
+	log.Debug("throttling request ", n)
+	w.Header().Set("Retry-After", "1")
+	writeError(w, http.StatusTooManyRequests, "rate limited")
+	return true
+}
+
+func (s *server) writeFixture(w http.ResponseWriter, name string) {
+	body, err := os.ReadFile(filepath.Join(s.fixtures, name))
+	if err != nil {
+		log.Error("fixture not found: ", name)
+		writeError(w, http.StatusNotFound, "fixture not found: "+name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// writeError answers with an error envelope shaped like Cloudflare's.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  false,
+		"errors":   []map[string]interface{}{{"code": 10000, "message": message}},
+		"messages": []string{},
+		"result":   nil,
+	})
+}
+
+func (s *server) graphql(w http.ResponseWriter, r *http.Request) {
+	if s.throttled(w) {
+		return
+	}
+	var req graphqlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	for _, f := range graphqlFixtures {
+		if strings.Contains(req.Query, f.dataset) && strings.Contains(req.Query, f.scope+"(") {
+			log.Debug("graphql: ", f.dataset, " -> ", f.fixture)
+			s.writeFixture(w, filepath.Join("graphql", f.fixture))
+			return
+		}
+	}
+
+	log.Warn("graphql: no fixture matches query")
+	s.writeFixture(w, filepath.Join("graphql", "empty.json"))
+}
+
+// rest serves /zones, /accounts, the per-zone firewall, ruleset and health
+// check endpoints and the per-account worker scripts. Paths map onto the
+// fixture tree with zone ids dropped, e.g. /zones/<id>/rulesets/<ruleset id>
+// is answered by rest/zone_ruleset.json.
+func (s *server) rest(w http.ResponseWriter, r *http.Request) {
+	if s.throttled(w) {
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	var fixture string
+	switch {
+	case len(parts) == 1 && parts[0] == "zones":
+		fixture = "zones.json"
+	case len(parts) == 1 && parts[0] == "accounts":
+		fixture = "accounts.json"
+	case len(parts) == 4 && parts[0] == "zones" && parts[2] == "firewall" && parts[3] == "rules":
+		fixture = "firewall_rules.json"
+	case len(parts) == 4 && parts[0] == "accounts" && parts[2] == "workers" && parts[3] == "scripts":
+		fixture = "workers_scripts.json"
+	case len(parts) == 3 && parts[0] == "zones" && parts[2] == "healthchecks":
+		fixture = "healthchecks.json"
+	case len(parts) == 3 && parts[0] == "zones" && parts[2] == "rulesets":
+		fixture = "zone_rulesets.json"
+	case len(parts) == 4 && parts[0] == "zones" && parts[2] == "rulesets":
+		fixture = "zone_ruleset.json"
+	default:
+		log.Warn("rest: no fixture for ", r.URL.Path)
+		writeError(w, http.StatusNotFound, "no route for "+r.URL.Path)
+		return
+	}
+
+	log.Debug("rest: ", r.URL.Path, " -> ", fixture)
+	s.writeFixture(w, filepath.Join("rest", fixture))
+}
+
+func main() {
+	listen := flag.String("listen", "localhost:8082", "listen on addr:port")
+	fixtures := flag.String("fixtures", "tests/fixtures", "directory with REST and GraphQL fixtures")
+	debug := flag.Bool("debug", false, "log every request")
+	throttle := flag.Int("throttle", 0, "answer every n-th request with 429, never if 0")
+	flag.Parse()
+
+	if *debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	s := &server{fixtures: *fixtures, throttle: *throttle}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/client/v4/graphql", s.graphql)
+	mux.HandleFunc("/client/v4/graphql/", s.graphql)
+	mux.Handle("/client/v4/", http.StripPrefix("/client/v4", http.HandlerFunc(s.rest)))
+
+	log.Info("Serving fake Cloudflare API on ", *listen, " from ", *fixtures)
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 3 * time.Second,
+	}
+
+	log.Fatal(server.ListenAndServe())
+}
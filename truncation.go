@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// graphqlLimit is the row limit of every GraphQL node the exporter queries.
+// A node returning exactly this many rows was most likely truncated.
+const graphqlLimit = 9999
+
+// minSplitWindow is the shortest window a truncated query is split into,
+// adaptive datasets are stored per second.
+const minSplitWindow = time.Second
+
+// minuteGrouped is implemented by nodes holding rows grouped per minute.
+// Splitting a window below a minute can't reduce these rows, so a node whose
+// per minute rows are truncated is only split down to a minute.
+type minuteGrouped interface {
+	minuteGroupsTruncated() bool
+}
+
+// graphqlNode is the per-zone or per-account node of a GraphQL response.
+type graphqlNode interface {
+	tag() string
+	truncated() bool
+}
+
+// fetchComplete runs query for ids in w. Zones or accounts whose node hit
+// the row limit are queried again on their own, in halves of the window,
+// until their results fit or the window can't be split any further. The
+// nodes of every sub-window are returned, adding up to the whole window, as
+// well as the ids still truncated.
+func fetchComplete[N graphqlNode](ctx context.Context, ids []string, w timeWindow, query func(ctx context.Context, ids []string, w timeWindow) ([]N, error)) ([]N, []string, error) {
+	nodes, err := query(ctx, ids, w)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var complete []N
+	var truncated []string
+	for _, n := range nodes {
+		if !n.truncated() {
+			complete = append(complete, n)
+			continue
+		}
+
+		shortest := minSplitWindow
+		if m, ok := any(n).(minuteGrouped); ok && m.minuteGroupsTruncated() {
+			shortest = time.Minute
+		}
+		first, second, ok := splitWindow(w, shortest)
+		if !ok {
+			complete = append(complete, n)
+			truncated = append(truncated, n.tag())
+			continue
+		}
+
+		log.Debug(n.tag(), ": result truncated, splitting window ", w.mintime.Format(time.RFC3339), " - ", w.maxtime.Format(time.RFC3339))
+		for _, half := range []timeWindow{first, second} {
+			sub, subTruncated, err := fetchComplete(ctx, []string{n.tag()}, half, query)
+			if err != nil {
+				return nil, nil, err
+			}
+			complete = append(complete, sub...)
+			truncated = append(truncated, subTruncated...)
+		}
+	}
+	return complete, truncated, nil
+}
+
+// splitWindow splits w in two near its middle, at a multiple of shortest
+// from its start.
+func splitWindow(w timeWindow, shortest time.Duration) (timeWindow, timeWindow, bool) {
+	half := (w.maxtime.Sub(w.mintime) / 2).Truncate(shortest)
+	if half < shortest {
+		return w, w, false
+	}
+	mid := w.mintime.Add(half)
+	return timeWindow{mintime: w.mintime, maxtime: mid}, timeWindow{mintime: mid, maxtime: w.maxtime}, true
+}
+
+func (z zoneResp) tag() string { return z.ZoneTag }
+
+func (z zoneResp) truncated() bool {
+	return len(z.HTTP1mGroups) >= graphqlLimit ||
+		len(z.FirewallEventsAdaptiveGroups) >= graphqlLimit ||
+		len(z.HTTPRequestsAdaptiveGroups) >= graphqlLimit ||
+		len(z.HTTPRequestsEdgeCountryHost) >= graphqlLimit ||
+		len(z.HealthCheckEventsAdaptiveGroups) >= graphqlLimit ||
+		len(z.HealthCheckFailures) >= graphqlLimit ||
+		len(z.HealthCheckEventsRtt) >= graphqlLimit
+}
+
+func (z zoneResp) minuteGroupsTruncated() bool {
+	return len(z.HTTP1mGroups) >= graphqlLimit
+}
+
+func (z zoneRespColo) tag() string { return z.ZoneTag }
+
+func (z zoneRespColo) truncated() bool {
+	return len(z.ColoGroups) >= graphqlLimit
+}
+
+func (z lbResp) tag() string { return z.ZoneTag }
+
+func (z lbResp) truncated() bool {
+	return len(z.LoadBalancingRequestsAdaptiveGroups) >= graphqlLimit ||
+		len(z.LoadBalancingRequestsAdaptive) >= graphqlLimit
+}
+
+func (a accountResp) tag() string { return a.AccountTag }
+
+func (a accountResp) truncated() bool {
+	return len(a.WorkersInvocationsAdaptive) >= graphqlLimit ||
+		len(a.WorkersSubrequestsAdaptiveGroups) >= graphqlLimit ||
+		len(a.WorkersInvocationsScheduled) >= graphqlLimit ||
+		len(a.QueueConsumerMetricsAdaptiveGroups) >= graphqlLimit ||
+		len(a.QueueBacklogAdaptiveGroups) >= graphqlLimit
+}
+
+func (l logpushResponse) tag() string {
+	if l.ZoneTag != "" {
+		return l.ZoneTag
+	}
+	return l.AccountTag
+}
+
+func (l logpushResponse) truncated() bool {
+	return len(l.LogpushHealthAdaptiveGroups) >= graphqlLimit
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func coloNode(tag string, rows int) zoneRespColo {
+	z := zoneRespColo{ZoneTag: tag}
+	z.ColoGroups = slices.Grow(z.ColoGroups, rows)[:rows]
+	return z
+}
+
+func TestFetchComplete(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		window     time.Duration
+		rowsPerSec map[string]int
+		wantRows   map[string]int
+		wantTrunc  []string
+		wantWindow time.Duration
+	}{
+		{
+			name:       "fits",
+			window:     time.Minute,
+			rowsPerSec: map[string]int{"a": 10, "b": 10},
+			wantRows:   map[string]int{"a": 600, "b": 600},
+			wantWindow: time.Minute,
+		},
+		{
+			name:       "one-minute window splits below a minute",
+			window:     time.Minute,
+			rowsPerSec: map[string]int{"a": 200, "b": 10},
+			wantRows:   map[string]int{"a": 12000, "b": 600},
+			wantWindow: 30 * time.Second,
+		},
+		{
+			name:       "long window splits repeatedly",
+			window:     5 * time.Minute,
+			rowsPerSec: map[string]int{"a": 100, "b": 1},
+			wantRows:   map[string]int{"a": 30000, "b": 300},
+			wantWindow: 75 * time.Second,
+		},
+		{
+			name:       "truncated at one second",
+			window:     4 * time.Second,
+			rowsPerSec: map[string]int{"a": 10000, "b": 1},
+			wantRows:   map[string]int{"a": 4 * graphqlLimit, "b": 4},
+			wantTrunc:  []string{"a", "a", "a", "a"},
+			wantWindow: time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shortest := tt.window
+			query := func(_ context.Context, ids []string, w timeWindow) ([]zoneRespColo, error) {
+				if d := w.maxtime.Sub(w.mintime); d < shortest {
+					shortest = d
+				}
+				var nodes []zoneRespColo
+				for _, id := range ids {
+					rows := tt.rowsPerSec[id] * int(w.maxtime.Sub(w.mintime)/time.Second)
+					nodes = append(nodes, coloNode(id, min(rows, graphqlLimit)))
+				}
+				return nodes, nil
+			}
+
+			nodes, truncated, err := fetchComplete(context.Background(), []string{"a", "b"}, timeWindow{mintime: start, maxtime: start.Add(tt.window)}, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows := map[string]int{}
+			for _, n := range nodes {
+				rows[n.ZoneTag] += len(n.ColoGroups)
+			}
+			if !reflect.DeepEqual(rows, tt.wantRows) {
+				t.Errorf("rows = %v, want %v", rows, tt.wantRows)
+			}
+			sort.Strings(truncated)
+			if !reflect.DeepEqual(truncated, tt.wantTrunc) {
+				t.Errorf("truncated = %v, want %v", truncated, tt.wantTrunc)
+			}
+			if shortest != tt.wantWindow {
+				t.Errorf("shortest window = %v, want %v", shortest, tt.wantWindow)
+			}
+		})
+	}
+}
+
+func TestFetchCompleteMinuteGroups(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	query := func(_ context.Context, ids []string, w timeWindow) ([]zoneResp, error) {
+		calls++
+		z := zoneResp{ZoneTag: ids[0]}
+		z.HTTP1mGroups = slices.Grow(z.HTTP1mGroups, graphqlLimit)[:graphqlLimit]
+		return []zoneResp{z}, nil
+	}
+
+	_, truncated, err := fetchComplete(context.Background(), []string{"a"}, timeWindow{mintime: start, maxtime: start.Add(time.Minute)}, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("queried %d times, want 1, per minute groups can't be split below a minute", calls)
+	}
+	if !reflect.DeepEqual(truncated, []string{"a"}) {
+		t.Errorf("truncated = %v, want [a]", truncated)
+	}
+}